@@ -2,7 +2,12 @@ module ziggytwister.com/tree-of-work
 
 go 1.21.3
 
-require github.com/charmbracelet/bubbletea v0.24.2
+require (
+	github.com/atotto/clipboard v0.1.4
+	github.com/charmbracelet/bubbles v0.16.1
+	github.com/charmbracelet/bubbletea v0.24.2
+	github.com/charmbracelet/lipgloss v0.7.1
+)
 
 require (
 	github.com/aymanbagabas/go-osc52/v2 v2.0.1 // indirect
@@ -1,3 +1,7 @@
 #!/usr/bin/env bash
 
-go build -ldflags="-s -w" tow.go
+VERSION=${VERSION:-$(git describe --tags --always --dirty)}
+COMMIT=$(git rev-parse --short HEAD)
+DATE=$(date -u +%Y-%m-%d)
+
+go build -ldflags="-s -w -X main.version=$VERSION -X main.commit=$COMMIT -X main.date=$DATE" -o tow .
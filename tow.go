@@ -1,354 +1,4409 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/atotto/clipboard"
+	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+
+	wt "ziggytwister.com/tree-of-work/worktree"
+)
+
+// worktree is short for the worktree package's type, the TUI uses it
+// everywhere.
+type worktree = wt.Worktree
+
+type ByModifiedAt []worktree
+
+func (a ByModifiedAt) Len() int           { return len(a) }
+func (a ByModifiedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByModifiedAt) Less(i, j int) bool { return sortOrders[0].less(a[i], a[j]) }
+
+// sortOrder describes how the worktree list is ordered on screen.
+type sortOrder struct {
+	column string
+	desc   bool
+}
+
+// sortOrders are cycled through with the "s" key.
+var sortOrders = []sortOrder{
+	{"modified", false},
+	{"modified", true},
+	{"name", false},
+	{"name", true},
+	{"branch", false},
+	{"branch", true},
+	{"commit", false},
+	{"commit", true},
+}
+
+func (o sortOrder) less(a worktree, b worktree) bool {
+	x, y := a, b
+	if o.desc {
+		x, y = b, a
+	}
+
+	switch o.column {
+	case "name":
+		if x.Name != y.Name {
+			return x.Name < y.Name
+		}
+	case "branch":
+		if x.Branch != y.Branch {
+			return x.Branch < y.Branch
+		}
+	case "commit":
+		if !x.LastCommitAt.Equal(y.LastCommitAt) {
+			return x.LastCommitAt.Before(y.LastCommitAt)
+		}
+	default:
+		if !x.ModifiedAt.Equal(y.ModifiedAt) {
+			return x.ModifiedAt.Before(y.ModifiedAt)
+		}
+	}
+
+	// Ties go by name, and then path, in the same direction whatever
+	// the order, so equal rows don't trade places between refreshes.
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+
+	return a.Path < b.Path
+}
+
+func (o sortOrder) String() string {
+	direction := "asc"
+	if o.desc {
+		direction = "desc"
+	}
+
+	return fmt.Sprintf("%s %s", o.column, direction)
+}
+
+// relativeTime renders how long ago t was in a short form like "3d ago".
+func relativeTime(t time.Time, now time.Time) string {
+	d := now.Sub(t)
+	day := 24 * time.Hour
+
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < day:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	case d < 30*day:
+		return fmt.Sprintf("%dd ago", int(d/day))
+	case d < 365*day:
+		return fmt.Sprintf("%dmo ago", int(d/(30*day)))
+	default:
+		return fmt.Sprintf("%dy ago", int(d/(365*day)))
+	}
+}
+
+// confirm tells which action waits for a yes or no from the user.
+type confirm int
+
+const (
+	confirmNone confirm = iota
+	confirmDelete
+	confirmForceDelete
+	confirmPrune
+	confirmMkdir
+	confirmClean
+)
+
+// prompt tells which question the input line is currently asking.
+type prompt int
+
+const (
+	promptNone prompt = iota
+	promptBranch
+	promptBase
+	promptFilter
+	promptMove
+	promptCheckout
+	promptRename
+	promptDetach
+	promptPR
+)
+
+type model struct {
+	runner         wt.Runner
+	gitPath        string
+	bareRepoPath   string
+	defaultBranch  string
+	cwd            string
+	dryRun         bool
+	readOnly       bool
+	repos          []string
+	repoStates     map[string]repoState
+	worktrees      []worktree
+	loaded         bool
+	cursor         int
+	selected       map[string]struct{}
+	errMsg         string
+	errorID        int
+	failed         map[string]bool
+	prompt         prompt
+	input          textinput.Model
+	newBranch      string
+	branches       []string
+	branchPick     int
+	completions    []string
+	completion     int
+	promptTree     worktree
+	confirm        confirm
+	pendingDelete  confirm
+	pruneable      []string
+	cleanable      []string
+	cleanTarget    worktree
+	missingDir     string
+	pendingAdd     tea.Cmd
+	unpushed       map[string]int
+	fileCounts     map[string]int
+	deleteBranches bool
+	archive        bool
+	lastDelete     deleteMsg
+	status         string
+	statusID       int
+	width          int
+	height         int
+	filter         string
+	filterRegexp   *regexp.Regexp
+	highlightOnly  bool
+	statusFilter   statusFilter
+	visible        []int
+	matches        []int
+	sortIndex      int
+	chosenPath     string
+	showHelp       bool
+	showInfo       bool
+	infoTitle      string
+	info           viewport.Model
+	absoluteTime   bool
+	commits        map[string]commitInfo
+	isLoading      bool
+	spinner        spinner.Model
+	columns        map[string]bool
+	sizes          map[string]sizeInfo
+	authors        map[string]string
+	config         config
+}
+
+// repoState is what's kept of a repo while another one is shown.
+type repoState struct {
+	worktrees     []worktree
+	loaded        bool
+	selected      map[string]struct{}
+	cursor        int
+	defaultBranch string
+}
+
+// config holds the options read from the config file.
+type config struct {
+	// Sort is the initial sort order, like "name asc" or "modified desc".
+	Sort string `json:"sort"`
+	// DeleteBranches makes deleting remove the branches by default.
+	DeleteBranches bool `json:"deleteBranches"`
+	// Keys maps extra keys to the built-in key they act like.
+	Keys map[string]string `json:"keys"`
+	// Editor is the command to edit a worktree with, instead of $EDITOR.
+	Editor string `json:"editor"`
+	// WrapNavigation moves the cursor from the last row to the first
+	// and back instead of stopping.
+	WrapNavigation bool `json:"wrapNavigation"`
+	// StaleAfterDays dims worktrees that haven't been modified for that
+	// many days. Zero means the default, a negative number turns it off.
+	StaleAfterDays int `json:"staleAfterDays"`
+	// PathTemplate is where new worktrees go, like "../worktrees/{branch}".
+	// Relative templates start from the repo.
+	PathTemplate string `json:"pathTemplate"`
+	// ArchiveDir is where deleting saves a git bundle of each worktree
+	// before removing it. Nothing is archived when it's empty.
+	ArchiveDir string `json:"archiveDir"`
+	// ConfirmDeleteFrom is how many worktrees a delete needs before
+	// it asks for confirmation. Zero means the default.
+	ConfirmDeleteFrom int `json:"confirmDeleteFrom"`
+	// Columns picks which of tableColumns the table shows, the
+	// worktree name is always there.
+	Columns []string `json:"columns"`
+	// CleanArgs are the git clean flags X runs with, like "-xfd -e .env".
+	// Empty means defaultCleanArgs.
+	CleanArgs string `json:"cleanArgs"`
+	// GitTimeout is how long a git command may take, like "30s".
+	// Empty means the default, a negative duration turns it off.
+	GitTimeout string `json:"gitTimeout"`
+}
+
+// defaultGitTimeout is long enough for a fetch of a big repo.
+const defaultGitTimeout = time.Minute
+
+// gitTimeout is the GitTimeout of the config, checked by loadConfig.
+func (c config) gitTimeout() time.Duration {
+	timeout, err := time.ParseDuration(c.GitTimeout)
+	if err != nil || timeout == 0 {
+		return defaultGitTimeout
+	}
+
+	return max(timeout, 0)
+}
+
+// tableColumns are the columns of the table that can be turned off,
+// in the order they're shown.
+var tableColumns = []string{"branch", "head", "author", "modified", "size", "status"}
+
+// defaultColumns leaves out the size, which takes a while to measure,
+// and the commit and its author, which only matter to some.
+var defaultColumns = []string{"branch", "modified", "status"}
+
+// columnSet turns a list of column names into the set the table checks.
+func columnSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		names = defaultColumns
+	}
+
+	columns := make(map[string]bool, len(names))
+	for _, name := range names {
+		columns[name] = true
+	}
+
+	return columns
+}
+
+// defaultStaleAfterDays is used when the config doesn't say otherwise.
+const defaultStaleAfterDays = 30
+
+// defaultConfirmDeleteFrom makes every delete ask first.
+const defaultConfirmDeleteFrom = 1
+
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "tow", "config.json"), nil
+}
+
+// loadConfig reads the config file. A missing file isn't an error,
+// it just means the defaults are used.
+func loadConfig() (config, error) {
+	var cfg config
+
+	path, err := configPath()
+	if err != nil {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if cfg.Sort != "" && sortIndex(cfg.Sort) < 0 {
+		return cfg, fmt.Errorf("%s: unknown sort order %q", path, cfg.Sort)
+	}
+
+	// Without the placeholder every worktree would get the same path.
+	if cfg.PathTemplate != "" && !strings.Contains(cfg.PathTemplate, "{branch}") {
+		return cfg, fmt.Errorf("%s: pathTemplate %q has no {branch} in it", path, cfg.PathTemplate)
+	}
+
+	for _, column := range cfg.Columns {
+		if !slices.Contains(tableColumns, column) {
+			return cfg, fmt.Errorf("%s: unknown column %q", path, column)
+		}
+	}
+
+	if cfg.GitTimeout != "" {
+		if _, err := time.ParseDuration(cfg.GitTimeout); err != nil {
+			return cfg, fmt.Errorf("%s: gitTimeout: %w", path, err)
+		}
+	}
+
+	if cfg.ArchiveDir != "" && !filepath.IsAbs(cfg.ArchiveDir) {
+		return cfg, fmt.Errorf("%s: archiveDir %q must be an absolute path", path, cfg.ArchiveDir)
+	}
+
+	return cfg, nil
+}
+
+// state is what the UI remembers between runs by itself, as opposed
+// to the config which the user writes.
+type state struct {
+	Sort string `json:"sort"`
+}
+
+func statePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "tow", "state.json"), nil
+}
+
+// loadState reads the state of the last run. It's only a convenience,
+// so a missing or broken state file just means starting fresh.
+func loadState() state {
+	var st state
+
+	path, err := statePath()
+	if err != nil {
+		return st
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return st
+	}
+
+	if err := json.Unmarshal(data, &st); err != nil || sortIndex(st.Sort) < 0 {
+		return state{}
+	}
+
+	return st
+}
+
+func saveState(st state) error {
+	path, err := statePath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
+
+// withSavedSort starts with the sort order picked with s last time,
+// which wins over the configured one.
+func (m model) withSavedSort() model {
+	if st := loadState(); st.Sort != "" {
+		m.sortIndex = sortIndex(st.Sort)
+	}
+
+	return m
+}
+
+// saveSort remembers the sort order for next time, but only when it
+// changed since start. Otherwise the config keeps deciding.
+func saveSort(start int, m model) error {
+	if m.sortIndex == start {
+		return nil
+	}
+
+	return saveState(state{Sort: sortOrders[m.sortIndex].String()})
+}
+
+// sortIndex finds the sort order with the given name, or returns -1.
+func sortIndex(name string) int {
+	for i, order := range sortOrders {
+		if order.String() == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// findGit picks the git binary: the one asked for with --git, then
+// the one in TOW_GIT, and otherwise whichever git is in the PATH.
+// Nothing works without it, so the error is meant to be shown to the
+// user as it is.
+func findGit(override string) (string, error) {
+	if override == "" {
+		override = os.Getenv("TOW_GIT")
+	}
+
+	if override != "" {
+		git, err := exec.LookPath(override)
+		if err != nil {
+			return "", fmt.Errorf("git not found at %s", override)
+		}
+		return git, nil
+	}
+
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return "", errors.New("git not found in PATH; please install git")
+	}
+
+	return git, nil
+}
+
+func initialModel(git string, repos []string, cfg config) model {
+	// Without a working directory no worktree is marked as current.
+	cwd, _ := os.Getwd()
+	if resolved, err := filepath.EvalSymlinks(cwd); err == nil {
+		cwd = resolved
+	}
+
+	return model{
+		runner:         wt.ExecRunner{Timeout: cfg.gitTimeout()},
+		cursor:         0,
+		gitPath:        git,
+		cwd:            cwd,
+		bareRepoPath:   repos[0],
+		repos:          repos,
+		repoStates:     make(map[string]repoState),
+		selected:       make(map[string]struct{}),
+		commits:        make(map[string]commitInfo),
+		sizes:          make(map[string]sizeInfo),
+		authors:        make(map[string]string),
+		input:          newInput(),
+		isLoading:      true,
+		spinner:        spinner.New(spinner.WithSpinner(spinner.Dot)),
+		width:          80,
+		height:         40,
+		config:         cfg,
+		sortIndex:      max(sortIndex(cfg.Sort), 0),
+		deleteBranches: cfg.DeleteBranches,
+		archive:        cfg.ArchiveDir != "",
+		columns:        columnSet(cfg.Columns),
+	}
+}
+
+func newInput() textinput.Model {
+	input := textinput.New()
+	input.Prompt = ""
+	return input
+}
+
+// commitInfo describes the latest commit of a worktree.
+// An entry with loaded unset is still being fetched.
+type commitInfo struct {
+	loaded  bool
+	subject string
+	author  string
+	date    string
+}
+
+type commitMsg struct {
+	path string
+	info commitInfo
+}
+
+// sizeInfo is how much disk space a worktree takes.
+// An entry with loaded unset is still being measured.
+type sizeInfo struct {
+	loaded bool
+	bytes  int64
+}
+
+// cleanMsg lists what git clean removed from a worktree, or would
+// remove when it was a dry run.
+type cleanMsg struct {
+	tree    worktree
+	dryRun  bool
+	entries []string
+}
+
+type sizeMsg struct {
+	path string
+	info sizeInfo
+}
+
+// authorMsg names who made a commit, by its hash.
+type authorMsg struct {
+	head string
+	name string
+}
+
+// deleteMsg reports which worktrees were removed, by path, and why
+// the others weren't.
+type deleteMsg struct {
+	deleted  []string
+	archived []string
+	failures []string
+	// failedPaths are the worktrees behind the failures.
+	failedPaths []string
+
+	// What undo needs to bring the worktrees back: the repo, the
+	// removed worktrees as they were and the branches deleted with them.
+	repo     string
+	trees    []worktree
+	branches []string
+}
+
+type restoreMsg int
+
+// actionMsg is how a command that changes something ended. The ones
+// that failed are kept by key, like "lock /code/feature", until the same
+// action works after all. Any left make tow exit with status 1.
+type actionMsg struct {
+	key string
+	msg tea.Msg
+}
+
+// mutating runs cmd and tags how it ended with key, see actionMsg. A
+// worktree that waits for its directory keeps the key.
+func mutating(key string, cmd tea.Cmd) tea.Cmd {
+	return func() tea.Msg {
+		msg := cmd()
+		if ask, ok := msg.(mkdirMsg); ok {
+			ask.add = mutating(key, ask.add)
+			msg = ask
+		}
+
+		return actionMsg{key, msg}
+	}
+}
+
+// mkdirMsg asks before a worktree gets added to a directory that
+// doesn't exist yet. add runs again once it's created.
+type mkdirMsg struct {
+	dir string
+	add tea.Cmd
+}
+
+type addMsg int
+type lockMsg int
+type moveMsg int
+type checkoutMsg string
+type editorMsg struct{ err error }
+type renameMsg string
+type syncMsg string
+
+// treeMsg is a fresh look at a single worktree.
+type treeMsg worktree
+
+// unpushedMsg counts the commits of each worktree, by path, that
+// aren't on any remote.
+type unpushedMsg map[string]int
+type fileCountMsg map[string]int
+
+// branchesMsg lists the local and remote branches of a repo.
+type branchesMsg struct {
+	repo     string
+	branches []string
+}
+
+// infoMsg carries what the info pane titled title shows, like the
+// status and diff summary of a worktree.
+type infoMsg struct {
+	title   string
+	content string
+}
+type statusMsg string
+
+// defaultBranchMsg and listMsg say which repo they're about, since the
+// user may have switched to another one while they were loading.
+type defaultBranchMsg struct {
+	repo   string
+	branch string
+}
+type clearStatusMsg int
+
+// statusTimeout is how long a status message stays on screen.
+const statusTimeout = 3 * time.Second
+
+type clearErrorMsg int
+
+// errorTimeout is how long an error stays on screen when the user
+// doesn't press anything. Errors tend to be longer than statuses.
+const errorTimeout = 10 * time.Second
+
+type pruneMsg struct {
+	dryRun  bool
+	entries []string
+}
+type errMsg struct {
+	err error
+	msg string
+}
+type listMsg struct {
+	repo      string
+	worktrees []worktree
+}
+
+// refreshMsg is the list r asked for, which gets a status of its own.
+type refreshMsg listMsg
+
+func (e errMsg) Error() string {
+	return e.err.Error()
+}
+
+// archiveFile is the bundle the worktree gets archived to, stamped
+// with the time so archiving the same name twice keeps both.
+func archiveFile(m model, tree worktree, now time.Time) string {
+	name := fmt.Sprintf("%s-%s.bundle", tree.Name, now.Format("20060102-150405"))
+	return filepath.Join(m.config.ArchiveDir, name)
+}
+
+// archiveArgs bundles the worktree's branch, or its HEAD when it's
+// detached, into file. Uncommitted changes aren't part of a bundle.
+func archiveArgs(tree worktree, file string) []string {
+	ref := tree.Branch
+	if tree.Detached {
+		ref = "HEAD"
+	}
+
+	return []string{"-C", tree.Path, "bundle", "create", file, ref}
+}
+
+// deleteTrees removes the selected worktrees one by one. A failure
+// doesn't stop the rest from being removed.
+func deleteTrees(m model, force bool) tea.Cmd {
+	return func() tea.Msg {
+		result := deleteMsg{repo: m.bareRepoPath}
+		var planned [][]string
+
+		repo := m.repo()
+		now := time.Now()
+
+		for _, tree := range selectedTrees(m) {
+			// Branches are only removed when asked for, and a
+			// detached worktree has no branch to remove.
+			removeBranch := m.deleteBranches && !tree.Detached
+
+			file := archiveFile(m, tree, now)
+			var archive []string
+			if m.archive {
+				archive = archiveArgs(tree, file)
+			}
+
+			if m.dryRun {
+				if archive != nil {
+					planned = append(planned, archive)
+				}
+				planned = append(planned, repo.RemoveArgs(tree, force))
+				if removeBranch {
+					planned = append(planned, repo.DeleteBranchArgs(tree.Branch, force))
+				}
+				continue
+			}
+
+			// A worktree that couldn't be archived is kept, the archive
+			// is the only way back after removing it.
+			if archive != nil {
+				if err := os.MkdirAll(m.config.ArchiveDir, 0o755); err != nil {
+					result.failures = append(result.failures, fmt.Sprintf("%s: %v", tree.Name, err))
+					result.failedPaths = append(result.failedPaths, tree.Path)
+					continue
+				}
+				archiveOut, archiveErr := m.runner.Run(m.gitPath, archive)
+				if archiveErr != nil {
+					result.failures = append(result.failures, fmt.Sprintf("%s: %s", tree.Name, wt.ErrorLine(archiveOut)))
+					result.failedPaths = append(result.failedPaths, tree.Path)
+					continue
+				}
+				result.archived = append(result.archived, file)
+			}
+
+			if err := repo.Remove(tree, force); err != nil {
+				result.failures = append(result.failures, fmt.Sprintf("%s: %s", tree.Name, err))
+				result.failedPaths = append(result.failedPaths, tree.Path)
+				continue
+			}
+			result.deleted = append(result.deleted, tree.Path)
+			result.trees = append(result.trees, tree)
+
+			if !removeBranch {
+				continue
+			}
+
+			if err := repo.DeleteBranch(tree.Branch, force); err != nil {
+				result.failures = append(result.failures, fmt.Sprintf("branch %s: %s", tree.Branch, err))
+				result.failedPaths = append(result.failedPaths, tree.Path)
+				continue
+			}
+			result.branches = append(result.branches, tree.Branch)
+		}
+
+		if m.dryRun {
+			return dryRunMsg(planned...)
+		}
+
+		return result
+	}
+}
+
+// restoreTrees undoes a delete as far as git can: deleted branches come
+// back at the commit they pointed at and the worktrees are added again
+// at their old paths. Uncommitted changes and untracked files are gone
+// for good.
+func restoreTrees(m model, last deleteMsg) tea.Cmd {
+	return func() tea.Msg {
+		var planned [][]string
+		var failures []string
+
+		for _, tree := range last.trees {
+			var commands [][]string
+			if slices.Contains(last.branches, tree.Branch) {
+				commands = append(commands, []string{"-C", last.repo, "branch", tree.Branch, tree.Head})
+			}
+
+			add := []string{"-C", last.repo, "worktree", "add", tree.Path, tree.Branch}
+			if tree.Detached {
+				add = []string{"-C", last.repo, "worktree", "add", "--detach", tree.Path, tree.Head}
+			}
+			commands = append(commands, add)
+
+			if m.dryRun {
+				planned = append(planned, commands...)
+				continue
+			}
+
+			for _, command := range commands {
+				out, err := m.runner.Run(m.gitPath, command)
+				if err != nil {
+					failures = append(failures, fmt.Sprintf("%s: %s", tree.Name, wt.ErrorLine(out)))
+					break
+				}
+			}
+		}
+
+		if m.dryRun {
+			return dryRunMsg(planned...)
+		}
+
+		if len(failures) > 0 {
+			err := fmt.Errorf("undo failed for %s", strings.Join(failures, "; "))
+			return errMsg{err, err.Error()}
+		}
+
+		return restoreMsg(len(last.trees))
+	}
+}
+
+// dryRunMsg reports the git commands an action would have run with
+// --dry-run, in a form that can be pasted into a shell.
+func dryRunMsg(commands ...[]string) tea.Msg {
+	if len(commands) == 0 {
+		return statusMsg("Dry run: nothing to do")
+	}
+
+	lines := make([]string, len(commands))
+	for i, args := range commands {
+		lines[i] = gitCommand(args)
+	}
+
+	return statusMsg("Dry run: " + strings.Join(lines, "; "))
+}
+
+// gitCommand quotes the arguments of a git command so it can be pasted
+// into a shell.
+func gitCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = arg
+		if arg == "" || strings.ContainsAny(arg, " \t'\"$\\") {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+
+	return "git " + strings.Join(quoted, " ")
+}
+
+// lockTree locks or unlocks the worktree so git won't prune or remove it.
+func lockTree(m model, tree worktree, lock bool) tea.Cmd {
+	return func() tea.Msg {
+		action := "unlock"
+		if lock {
+			action = "lock"
+		}
+
+		lockWorktree := []string{"-C", m.bareRepoPath, "worktree", action, tree.Path}
+		if m.dryRun {
+			return dryRunMsg(lockWorktree)
+		}
+
+		lockOut, lockErr := m.runner.Run(m.gitPath, lockWorktree)
+		if lockErr != nil {
+			return errMsg{lockErr, wt.ErrorLine(lockOut)}
+		}
+
+		return lockMsg(0)
+	}
+}
+
+// pruneTrees cleans up administrative files of worktrees whose
+// directory is gone. With dryRun it only reports what would be pruned.
+func pruneTrees(m model, dryRun bool) tea.Cmd {
+	return func() tea.Msg {
+		pruneWorktrees := []string{"-C", m.bareRepoPath, "worktree", "prune", "--verbose"}
+		if dryRun {
+			pruneWorktrees = append(pruneWorktrees, "--dry-run")
+		} else if m.dryRun {
+			return dryRunMsg(pruneWorktrees)
+		}
+
+		pruneOut, pruneErr := m.runner.Run(m.gitPath, pruneWorktrees)
+		if pruneErr != nil {
+			return errMsg{pruneErr, wt.ErrorLine(pruneOut)}
+		}
+
+		var entries []string
+		for _, line := range pruneOut {
+			if strings.HasPrefix(line, "Removing ") {
+				entries = append(entries, strings.TrimPrefix(line, "Removing "))
+			}
+		}
+
+		return pruneMsg{dryRun, entries}
+	}
+}
+
+// defaultCleanArgs removes everything git doesn't track, ignored files
+// included, which is where build output ends up.
+const defaultCleanArgs = "-xfd"
+
+// cleanCommand is the git clean that X runs in the worktree. The dry
+// run only lists what would be removed.
+func cleanCommand(m model, tree worktree, dryRun bool) []string {
+	flags := strings.Fields(m.config.CleanArgs)
+	if len(flags) == 0 {
+		flags = strings.Fields(defaultCleanArgs)
+	}
+
+	args := append([]string{"-C", tree.Path, "clean"}, flags...)
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+
+	return args
+}
+
+// cleanTree removes untracked files from the worktree, or with dryRun
+// only reports what it would remove.
+func cleanTree(m model, tree worktree, dryRun bool) tea.Cmd {
+	return func() tea.Msg {
+		clean := cleanCommand(m, tree, dryRun)
+		if !dryRun && m.dryRun {
+			return dryRunMsg(clean)
+		}
+
+		cleanOut, cleanErr := m.runner.Run(m.gitPath, clean)
+		if cleanErr != nil {
+			return errMsg{cleanErr, wt.ErrorLine(cleanOut)}
+		}
+
+		var entries []string
+		for _, line := range cleanOut {
+			for _, prefix := range []string{"Would remove ", "Removing "} {
+				if strings.HasPrefix(line, prefix) {
+					entries = append(entries, strings.TrimPrefix(line, prefix))
+				}
+			}
+		}
+
+		return cleanMsg{tree, dryRun, entries}
+	}
+}
+
+// repairTrees fixes the links between the repo and its worktrees, which
+// break when the repo is moved on disk. Git's report ends up in the
+// status.
+func repairTrees(m model) tea.Cmd {
+	return func() tea.Msg {
+		repair := []string{"-C", m.bareRepoPath, "worktree", "repair"}
+		if m.dryRun {
+			return dryRunMsg(repair)
+		}
+
+		repairOut, repairErr := m.runner.Run(m.gitPath, repair)
+		if repairErr != nil {
+			return errMsg{repairErr, wt.ErrorLine(repairOut)}
+		}
+
+		var repaired []string
+		for _, line := range repairOut {
+			if line = strings.TrimSpace(line); line != "" {
+				repaired = append(repaired, line)
+			}
+		}
+
+		if len(repaired) == 0 {
+			return statusMsg("Nothing to repair")
+		}
+
+		return statusMsg("Repaired: " + strings.Join(repaired, "; "))
+	}
+}
+
+// isSelected tells whether the worktree is part of the selection.
+// Selection is keyed by path so it survives sorting and refreshes.
+func (m model) isSelected(tree worktree) bool {
+	_, ok := m.selected[tree.Path]
+	return ok
+}
+
+// current returns the worktree under the cursor.
+func (m model) current() (worktree, bool) {
+	if len(m.visible) == 0 {
+		return worktree{}, false
+	}
+
+	return m.worktrees[m.visible[m.cursor]], true
+}
+
+// loadCommit fetches the latest commit of the worktree under the cursor
+// unless it's already known or on its way.
+func loadCommit(m model) tea.Cmd {
+	tree, ok := m.current()
+	if !ok {
+		return nil
+	}
+
+	if _, known := m.commits[tree.Path]; known {
+		return nil
+	}
+	m.commits[tree.Path] = commitInfo{}
+
+	return func() tea.Msg {
+		logArgs := []string{"-C", tree.Path, "log", "-1", "--format=%s%x00%an%x00%cr"}
+		logOut, logErr := m.runner.Run(m.gitPath, logArgs)
+
+		info := commitInfo{loaded: true}
+		if logErr == nil {
+			fields := strings.Split(logOut[0], "\x00")
+			if len(fields) == 3 {
+				info.subject = fields[0]
+				info.author = fields[1]
+				info.date = fields[2]
+			}
+		}
+
+		return commitMsg{tree.Path, info}
+	}
+}
+
+// loadSizes measures the worktrees that aren't measured yet, each in
+// its own command so big worktrees don't hold up the small ones.
+func loadSizes(m model) tea.Cmd {
+	if !m.columns["size"] {
+		return nil
+	}
+
+	var cmds []tea.Cmd
+	for _, tree := range m.worktrees {
+		if _, known := m.sizes[tree.Path]; known || tree.Prunable {
+			continue
+		}
+		m.sizes[tree.Path] = sizeInfo{}
+
+		path := tree.Path
+		cmds = append(cmds, func() tea.Msg {
+			return sizeMsg{path, sizeInfo{loaded: true, bytes: dirSize(path)}}
+		})
+	}
+
+	return tea.Batch(cmds...)
+}
+
+// loadAuthors looks up who made the HEAD commit of each worktree, one
+// git call per worktree. Authors are kept by commit, so they stay
+// right for as long as HEAD doesn't move.
+func loadAuthors(m model) tea.Cmd {
+	if !m.columns["author"] {
+		return nil
+	}
+
+	var cmds []tea.Cmd
+	for _, tree := range m.worktrees {
+		if _, known := m.authors[tree.Head]; known || tree.Head == "" || tree.Prunable {
+			continue
+		}
+		m.authors[tree.Head] = ""
+
+		tree := tree
+		cmds = append(cmds, func() tea.Msg {
+			logArgs := []string{"-C", tree.Path, "log", "-1", "--format=%an", tree.Head}
+			logOut, logErr := m.runner.Run(m.gitPath, logArgs)
+			if logErr != nil || strings.TrimSpace(logOut[0]) == "" {
+				return authorMsg{tree.Head, "-"}
+			}
+
+			return authorMsg{tree.Head, strings.TrimSpace(logOut[0])}
+		})
+	}
+
+	return tea.Batch(cmds...)
+}
+
+// dirSize adds up the sizes of the files under the directory. Whatever
+// can't be read is skipped rather than failing the whole walk.
+func dirSize(root string) int64 {
+	var total int64
+
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+
+	return total
+}
+
+// countFiles counts the files under the directory, the way deleting
+// it would find them.
+func countFiles(root string) int {
+	count := 0
+
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			count++
+		}
+		return nil
+	})
+
+	return count
+}
+
+// humanSize formats a byte count the way du -h does, like 1.5M.
+func humanSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	size := float64(bytes) / unit
+	for _, suffix := range []string{"K", "M", "G", "T"} {
+		if size < unit || suffix == "T" {
+			return fmt.Sprintf("%.1f%s", size, suffix)
+		}
+		size /= unit
+	}
+
+	return ""
+}
+
+// worktreesDir is where new worktrees go and where relative paths
+// start from. Bare repos keep their worktrees inside, a normal
+// checkout gets them next to it so they don't end up in its files.
+func worktreesDir(m model) string {
+	for _, tree := range m.worktrees {
+		if tree.Main {
+			return filepath.Dir(tree.Path)
+		}
+	}
+
+	return m.bareRepoPath
+}
+
+// moveTree relocates the worktree to a new directory. Git would move
+// it inside an existing directory, so that case is refused up front.
+func moveTree(m model, tree worktree, destination string) tea.Cmd {
+	return func() tea.Msg {
+		if !filepath.IsAbs(destination) {
+			destination = filepath.Join(worktreesDir(m), destination)
+		}
+
+		if _, err := os.Stat(destination); err == nil {
+			err := fmt.Errorf("%s already exists", destination)
+			return errMsg{err, err.Error()}
+		}
+
+		moveWorktree := []string{"-C", m.bareRepoPath, "worktree", "move", tree.Path, destination}
+		if m.dryRun {
+			return dryRunMsg(moveWorktree)
+		}
+
+		moveOut, moveErr := m.runner.Run(m.gitPath, moveWorktree)
+		if moveErr != nil {
+			return errMsg{moveErr, wt.ErrorLine(moveOut)}
+		}
+
+		return moveMsg(0)
+	}
+}
+
+// checkoutTree switches the worktree over to another branch. Git
+// refuses when local changes would be overwritten, and that error is
+// passed on as it is.
+func checkoutTree(m model, tree worktree, branch string) tea.Cmd {
+	return func() tea.Msg {
+		checkout := []string{"-C", tree.Path, "checkout", branch}
+		if m.dryRun {
+			return dryRunMsg(checkout)
+		}
+
+		checkoutOut, checkoutErr := m.runner.Run(m.gitPath, checkout)
+		if checkoutErr != nil {
+			return errMsg{checkoutErr, wt.ErrorLine(checkoutOut)}
+		}
+
+		return checkoutMsg(fmt.Sprintf("Checked out %s in %s", branch, tree.Name))
+	}
+}
+
+// renameBranch renames the branch checked out in the worktree. An
+// existing branch with the new name is never overwritten.
+func renameBranch(m model, tree worktree, name string) tea.Cmd {
+	return func() tea.Msg {
+		if branchExists(m, name) {
+			err := fmt.Errorf("branch %s already exists", name)
+			return errMsg{err, err.Error()}
+		}
+
+		rename := []string{"-C", tree.Path, "branch", "-m", name}
+		if m.dryRun {
+			return dryRunMsg(rename)
+		}
+
+		renameOut, renameErr := m.runner.Run(m.gitPath, rename)
+		if renameErr != nil {
+			return errMsg{renameErr, wt.ErrorLine(renameOut)}
+		}
+
+		return renameMsg(fmt.Sprintf("Renamed %s to %s", tree.Branch, name))
+	}
+}
+
+// syncTree fetches or pulls in the worktree. Both go over the
+// network, so this may take a while.
+func syncTree(m model, tree worktree, pull bool) tea.Cmd {
+	return func() tea.Msg {
+		action, done := "fetch", "Fetched"
+		if pull {
+			// Only fast-forward, a merge or a rebase could leave the
+			// worktree in a state that needs a terminal to sort out.
+			action, done = "pull", "Pulled"
+		}
+
+		sync := []string{"-C", tree.Path, action}
+		if pull {
+			sync = append(sync, "--ff-only")
+		}
+		if m.dryRun {
+			return dryRunMsg(sync)
+		}
+
+		syncOut, syncErr := m.runner.Run(m.gitPath, sync)
+		if syncErr != nil {
+			return errMsg{syncErr, wt.ErrorLine(syncOut)}
+		}
+
+		return syncMsg(fmt.Sprintf("%s %s", done, tree.Name))
+	}
+}
+
+// loadBranches lists the local branches and then the remote ones, the
+// way git branch -a does, minus the remotes' HEAD pointers.
+func loadBranches(m model) tea.Cmd {
+	return func() tea.Msg {
+		refs := []string{"-C", m.bareRepoPath, "for-each-ref", "--format=%(refname)", "refs/heads", "refs/remotes"}
+		refsOut, refsErr := m.runner.Run(m.gitPath, refs)
+		if refsErr != nil {
+			return errMsg{refsErr, wt.ErrorLine(refsOut)}
+		}
+
+		var branches []string
+		for _, ref := range refsOut {
+			if ref == "" || strings.HasSuffix(ref, "/HEAD") {
+				continue
+			}
+			if name, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+				branches = append(branches, name)
+			} else if name, ok := strings.CutPrefix(ref, "refs/remotes/"); ok {
+				branches = append(branches, name)
+			}
+		}
+
+		return branchesMsg{m.bareRepoPath, branches}
+	}
+}
+
+// loadFileCounts counts the files deleting the selected worktrees
+// removes from disk. Worktrees that are already gone are left out.
+func loadFileCounts(m model) tea.Cmd {
+	trees := selectedTrees(m)
+
+	return func() tea.Msg {
+		counts := make(fileCountMsg)
+		for _, tree := range trees {
+			if !tree.Prunable {
+				counts[tree.Path] = countFiles(tree.Path)
+			}
+		}
+
+		return counts
+	}
+}
+
+// loadUnpushed counts the commits in the selected worktrees that no
+// remote has, which deleting them could lose. A repo without remotes
+// has nothing to compare against, so it isn't checked.
+func loadUnpushed(m model) tea.Cmd {
+	trees := selectedTrees(m)
+
+	return func() tea.Msg {
+		remotes, err := m.runner.Run(m.gitPath, []string{"-C", m.bareRepoPath, "remote"})
+		if err != nil || strings.TrimSpace(strings.Join(remotes, "")) == "" {
+			return unpushedMsg(nil)
+		}
+
+		unpushed := make(unpushedMsg)
+		for _, tree := range trees {
+			if tree.Prunable {
+				continue
+			}
+
+			count := []string{"-C", tree.Path, "rev-list", "--count", "HEAD", "--not", "--remotes"}
+			countOut, countErr := m.runner.Run(m.gitPath, count)
+			if countErr != nil {
+				continue
+			}
+			if n, err := strconv.Atoi(strings.TrimSpace(countOut[0])); err == nil && n > 0 {
+				unpushed[tree.Path] = n
+			}
+		}
+
+		return unpushed
+	}
+}
+
+// editorCommand picks the editor from the config, then from $VISUAL
+// and $EDITOR. It may come with arguments, like "code --wait".
+func editorCommand(m model) []string {
+	for _, editor := range []string{m.config.Editor, os.Getenv("VISUAL"), os.Getenv("EDITOR")} {
+		if fields := strings.Fields(editor); len(fields) > 0 {
+			return fields
+		}
+	}
+
+	return nil
+}
+
+// openEditor hands the terminal over to the editor, opened in the
+// worktree's directory, and takes it back once the editor exits.
+func openEditor(m model, tree worktree) tea.Cmd {
+	editor := editorCommand(m)
+	if editor == nil {
+		return func() tea.Msg {
+			err := errors.New("no editor set, set $EDITOR or \"editor\" in the config")
+			return errMsg{err, err.Error()}
+		}
+	}
+
+	cmd := exec.Command(editor[0], append(editor[1:], ".")...)
+	cmd.Dir = tree.Path
+
+	return tea.ExecProcess(cmd, func(err error) tea.Msg {
+		return editorMsg{err}
+	})
+}
+
+func infoTitle(tree worktree) string {
+	return fmt.Sprintf("%s (%s)", tree.Name, tree.Path)
+}
+
+// compareTrees summarizes the differences between the commits checked
+// out in two worktrees, going from a to b.
+func compareTrees(m model, a worktree, b worktree) tea.Cmd {
+	return func() tea.Msg {
+		title := compareTitle(a, b)
+
+		diff := []string{"-C", m.bareRepoPath, "diff", "--stat", treeRef(a) + ".." + treeRef(b)}
+		diffOut, diffErr := m.runner.Run(m.gitPath, diff)
+		if diffErr != nil {
+			return errMsg{diffErr, wt.ErrorLine(diffOut)}
+		}
+
+		content := strings.TrimSpace(strings.Join(diffOut, "\n"))
+		if content == "" {
+			content = "No differences"
+		}
+
+		return infoMsg{title, content}
+	}
+}
+
+// treeRef names what the worktree has checked out, for git commands.
+func treeRef(tree worktree) string {
+	if tree.Detached {
+		return tree.Head
+	}
+
+	return tree.Branch
+}
+
+func compareTitle(a worktree, b worktree) string {
+	return fmt.Sprintf("%s..%s", branchLabel(a), branchLabel(b))
+}
+
+// loadInfo collects git's status and a diff summary of the worktree,
+// to see what would be lost by deleting it.
+func loadInfo(m model, tree worktree) tea.Cmd {
+	return func() tea.Msg {
+		var content strings.Builder
+
+		statusArgs := []string{"-C", tree.Path, "status"}
+		statusOut, _ := m.runner.Run(m.gitPath, statusArgs)
+		content.WriteString(strings.TrimSpace(strings.Join(statusOut, "\n")))
+
+		diffArgs := []string{"-C", tree.Path, "diff", "--stat", "HEAD"}
+		diffOut, diffErr := m.runner.Run(m.gitPath, diffArgs)
+		if diffErr == nil && strings.TrimSpace(strings.Join(diffOut, "")) != "" {
+			content.WriteString("\n\nChanges since HEAD:\n\n")
+			content.WriteString(strings.TrimSpace(strings.Join(diffOut, "\n")))
+		}
+
+		return infoMsg{infoTitle(tree), content.String()}
+	}
+}
+
+// fileManager is the command that opens a directory in the file
+// manager of the platform.
+func fileManager() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "open"
+	case "windows":
+		return "explorer"
+	default:
+		return "xdg-open"
+	}
+}
+
+// revealTree opens the worktree in the file manager, which goes on
+// running on its own.
+func revealTree(tree worktree) tea.Cmd {
+	return func() tea.Msg {
+		opener := fileManager()
+		cmd := exec.Command(opener, tree.Path)
+		if err := cmd.Start(); err != nil {
+			return errMsg{err, fmt.Sprintf("couldn't run %s: %v", opener, err)}
+		}
+		go cmd.Wait()
+
+		return statusMsg(fmt.Sprintf("Opened %s in the file manager", tree.Name))
+	}
+}
+
+// copyToClipboard puts text on the system clipboard and reports
+// back with a status message.
+func copyToClipboard(text string, what string) tea.Cmd {
+	return func() tea.Msg {
+		if err := clipboard.WriteAll(text); err != nil {
+			return errMsg{err, fmt.Sprintf("couldn't copy to the clipboard: %v", err)}
+		}
+
+		return statusMsg(fmt.Sprintf("Copied %s: %s", what, text))
+	}
+}
+
+func branchExists(m model, branch string) bool {
+	verifyBranch := []string{"-C", m.bareRepoPath, "rev-parse", "--verify", "--quiet", "refs/heads/" + branch}
+	_, err := m.runner.Run(m.gitPath, verifyBranch)
+
+	return err == nil
+}
+
+func remoteBranchExists(m model, ref string) bool {
+	verifyRef := []string{"-C", m.bareRepoPath, "rev-parse", "--verify", "--quiet", "refs/remotes/" + ref}
+	_, err := m.runner.Run(m.gitPath, verifyRef)
+
+	return err == nil
+}
+
+// remoteRef tells whether ref starts with the name of one of the repo's
+// remotes, like origin/feature-x, and returns the branch part.
+func remoteRef(m model, ref string) (string, bool) {
+	remote, branch, found := strings.Cut(ref, "/")
+	if !found || branch == "" {
+		return "", false
+	}
+
+	remotes, err := m.runner.Run(m.gitPath, []string{"-C", m.bareRepoPath, "remote"})
+	if err != nil {
+		return "", false
+	}
+
+	if !slices.Contains(remotes, remote) {
+		return "", false
+	}
+
+	return branch, true
+}
+
+// addTree creates a worktree named after the branch, see worktreesDir.
+// An existing branch gets checked out, otherwise a new one is created
+// from base (or from HEAD when base is empty). A remote branch as the
+// base, or as the name itself, gets a local branch tracking it.
+func addTree(m model, branch string, base string) tea.Cmd {
+	return func() tea.Msg {
+		if name, ok := remoteRef(m, branch); ok && base == "" {
+			base = branch
+			branch = name
+		}
+
+		tracking := false
+		if base != "" {
+			_, tracking = remoteRef(m, base)
+		}
+
+		if tracking && !remoteBranchExists(m, base) {
+			err := fmt.Errorf("remote branch %s doesn't exist, maybe it needs a fetch", base)
+			return errMsg{err, err.Error()}
+		}
+
+		path := newTreePath(m, branch)
+		addWorktree := []string{"-C", m.bareRepoPath, "worktree", "add"}
+
+		switch {
+		case tracking && branchExists(m, branch):
+			err := fmt.Errorf("branch %s already exists, pick another name to track %s", branch, base)
+			return errMsg{err, err.Error()}
+
+		case tracking:
+			addWorktree = append(addWorktree, "--track", "-b", branch, path, base)
+
+		case branchExists(m, branch):
+			addWorktree = append(addWorktree, path, branch)
+
+		default:
+			addWorktree = append(addWorktree, "-b", branch, path)
+			if base != "" {
+				addWorktree = append(addWorktree, base)
+			}
+		}
+
+		if m.dryRun {
+			return dryRunMsg(addWorktree)
+		}
+
+		if dir := missingParent(m, path); dir != "" {
+			return mkdirMsg{dir, addTree(m, branch, base)}
+		}
+
+		addOut, addErr := m.runner.Run(m.gitPath, addWorktree)
+		if addErr != nil {
+			return errMsg{addErr, wt.ErrorLine(addOut)}
+		}
+
+		return addMsg(0)
+	}
+}
+
+// missingParent returns the directory the worktree at path would go
+// into when it doesn't exist yet. Git would quietly create it, but a
+// typo in the path shouldn't leave new directories around.
+func missingParent(m model, path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(m.bareRepoPath, path)
+	}
+
+	// The repo and the directory it's in are there already.
+	dir := filepath.Dir(path)
+	if dir == m.bareRepoPath || dir == worktreesDir(m) {
+		return ""
+	}
+
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return dir
+	}
+
+	return ""
+}
+
+// createDir makes the missing directory and then runs the add that
+// was waiting for it.
+func createDir(dir string, add tea.Cmd) tea.Cmd {
+	return func() tea.Msg {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return errMsg{err, err.Error()}
+		}
+
+		return add()
+	}
+}
+
+// newTreePath is where addTree puts a worktree called name. The
+// configured path template wins over the default place.
+func newTreePath(m model, name string) string {
+	if m.config.PathTemplate != "" {
+		// A branch like feature/foo becomes a single directory
+		// instead of a feature directory with foo inside.
+		path := strings.ReplaceAll(m.config.PathTemplate, "{branch}", strings.ReplaceAll(name, "/", "-"))
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(m.bareRepoPath, path)
+		}
+		return path
+	}
+
+	// Relative paths are taken from the repo, which already is the
+	// right place in a bare one.
+	if dir := worktreesDir(m); dir != m.bareRepoPath {
+		return filepath.Join(dir, name)
+	}
+
+	return name
+}
+
+// addDetachedTree creates a throwaway worktree at ref without a branch.
+// It's named after ref, with slashes turned into dashes so a remote
+// branch or a tag like release/1.0 doesn't end up in a subdirectory.
+func addDetachedTree(m model, ref string) tea.Cmd {
+	return func() tea.Msg {
+		path := newTreePath(m, strings.ReplaceAll(ref, "/", "-"))
+		addWorktree := []string{"-C", m.bareRepoPath, "worktree", "add", "--detach", path, ref}
+
+		if m.dryRun {
+			return dryRunMsg(addWorktree)
+		}
+
+		if dir := missingParent(m, path); dir != "" {
+			return mkdirMsg{dir, addDetachedTree(m, ref)}
+		}
+
+		addOut, addErr := m.runner.Run(m.gitPath, addWorktree)
+		if addErr != nil {
+			return errMsg{addErr, wt.ErrorLine(addOut)}
+		}
+
+		return addMsg(0)
+	}
+}
+
+// pullRemote picks the remote pull requests are fetched from: origin
+// when there is one, otherwise the only remote the repo has.
+func pullRemote(m model) (string, error) {
+	remotesOut, err := m.runner.Run(m.gitPath, []string{"-C", m.bareRepoPath, "remote"})
+	if err != nil {
+		return "", &wt.Error{Output: remotesOut, Err: err}
+	}
+
+	var remotes []string
+	for _, remote := range remotesOut {
+		if remote = strings.TrimSpace(remote); remote != "" {
+			remotes = append(remotes, remote)
+		}
+	}
+
+	switch {
+	case slices.Contains(remotes, "origin"):
+		return "origin", nil
+	case len(remotes) == 1:
+		return remotes[0], nil
+	case len(remotes) == 0:
+		return "", errors.New("the repo has no remote to fetch pull requests from")
+	}
+
+	return "", fmt.Errorf("no origin to fetch pull requests from, only %s", strings.Join(remotes, ", "))
+}
+
+// addPullRequestTree fetches the head of a GitHub pull request into a
+// pr-<number> branch and creates a worktree for it.
+func addPullRequestTree(m model, number int) tea.Cmd {
+	return func() tea.Msg {
+		remote, err := pullRemote(m)
+		if err != nil {
+			return errMsg{err, err.Error()}
+		}
+
+		branch := fmt.Sprintf("pr-%d", number)
+		path := newTreePath(m, branch)
+		fetch := []string{"-C", m.bareRepoPath, "fetch", remote, fmt.Sprintf("pull/%d/head:%s", number, branch)}
+		addWorktree := []string{"-C", m.bareRepoPath, "worktree", "add", path, branch}
+
+		if m.dryRun {
+			return dryRunMsg(fetch, addWorktree)
+		}
+
+		if dir := missingParent(m, path); dir != "" {
+			return mkdirMsg{dir, addPullRequestTree(m, number)}
+		}
+
+		fetchOut, fetchErr := m.runner.Run(m.gitPath, fetch)
+		if fetchErr != nil {
+			return errMsg{fetchErr, fmt.Sprintf("fetching pull request #%d from %s failed: %s", number, remote, wt.ErrorLine(fetchOut))}
+		}
+
+		addOut, addErr := m.runner.Run(m.gitPath, addWorktree)
+		if addErr != nil {
+			return errMsg{addErr, wt.ErrorLine(addOut)}
+		}
+
+		return addMsg(0)
+	}
+}
+
+// refreshTrees lists the worktrees again like listTrees, but tells
+// that it worked once the list is in.
+func refreshTrees(m model) tea.Cmd {
+	list := listTrees(m)
+
+	return func() tea.Msg {
+		msg := list()
+		if trees, ok := msg.(listMsg); ok {
+			return refreshMsg(trees)
+		}
+
+		return msg
+	}
+}
+
+func listTrees(m model) tea.Cmd {
+	return func() tea.Msg {
+		worktrees, err := m.repo().List()
+		if err != nil {
+			return errMsg{err, err.Error()}
+		}
+
+		sort.Sort(ByModifiedAt(worktrees))
+
+		return listMsg{m.bareRepoPath, worktrees}
+	}
+}
+
+// loadDefaultBranch finds the branch the bare repo's HEAD points at.
+// Repos with a dangling or detached HEAD just don't get one.
+func loadDefaultBranch(m model) tea.Cmd {
+	return func() tea.Msg {
+		args := []string{"-C", m.bareRepoPath, "symbolic-ref", "--short", "HEAD"}
+		lines, err := m.runner.Run(m.gitPath, args)
+		if err != nil || len(lines) == 0 {
+			return nil
+		}
+
+		return defaultBranchMsg{m.bareRepoPath, lines[0]}
+	}
+}
+
+// refreshTree takes a fresh look at a single worktree, which is a lot
+// quicker than listing them all again.
+func refreshTree(m model, tree worktree) tea.Cmd {
+	return func() tea.Msg {
+		head := []string{"-C", tree.Path, "rev-parse", "HEAD"}
+		headOut, headErr := m.runner.Run(m.gitPath, head)
+		if headErr != nil {
+			return errMsg{headErr, wt.ErrorLine(headOut)}
+		}
+		tree.Head = headOut[0]
+
+		// symbolic-ref fails on a detached HEAD.
+		branch := []string{"-C", tree.Path, "symbolic-ref", "--short", "--quiet", "HEAD"}
+		branchOut, branchErr := m.runner.Run(m.gitPath, branch)
+		tree.Detached = branchErr != nil
+		tree.Branch = "(detached)"
+		if !tree.Detached {
+			tree.Branch = branchOut[0]
+		}
+
+		return treeMsg(m.repo().Inspect(tree))
+	}
+}
+
+func (m model) Init() tea.Cmd {
+	return tea.Batch(listTrees(m), loadDefaultBranch(m), m.spinner.Tick)
+}
+
+// statusFilter narrows the list down to dirty or clean worktrees,
+// whatever the text filter is.
+type statusFilter int
+
+const (
+	statusAll statusFilter = iota
+	statusDirty
+	statusClean
+)
+
+func (f statusFilter) String() string {
+	switch f {
+	case statusDirty:
+		return "dirty"
+	case statusClean:
+		return "clean"
+	}
+
+	return "all"
+}
+
+// keeps tells whether the worktree stays in the list.
+func (f statusFilter) keeps(tree worktree) bool {
+	switch f {
+	case statusDirty:
+		return tree.Dirty
+	case statusClean:
+		return !tree.Dirty
+	}
+
+	return true
+}
+
+// filterRegexp compiles a filter starting with a slash as a regular
+// expression, ignoring case. Anything else, including a pattern that
+// doesn't compile, gives nil and is matched as plain text.
+func filterRegexp(filter string) *regexp.Regexp {
+	pattern, ok := strings.CutPrefix(filter, "/")
+	if !ok {
+		return nil
+	}
+
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil
+	}
+
+	return re
+}
+
+// matchesFilter tells whether the worktree's name or branch matches
+// the filter, ignoring case. It's a regular expression when it starts
+// with a slash and a plain substring otherwise.
+func (m model) matchesFilter(tree worktree) bool {
+	if m.filterRegexp != nil {
+		return m.filterRegexp.MatchString(tree.Name) || m.filterRegexp.MatchString(tree.Branch)
+	}
+
+	query := strings.ToLower(strings.TrimPrefix(m.filter, "/"))
+
+	return strings.Contains(strings.ToLower(tree.Name), query) ||
+		strings.Contains(strings.ToLower(tree.Branch), query)
+}
+
+// applyFilter rebuilds the list of visible worktree indices, ordered by
+// the active sort order. Normally only worktrees matching the filter are
+// visible. In highlight mode all of them are, and the positions of the
+// matching ones are kept in matches.
+func (m model) applyFilter() model {
+	order := sortOrders[m.sortIndex]
+	m.filterRegexp = filterRegexp(m.filter)
+
+	keys := make([]int, len(m.worktrees))
+	for k := range m.worktrees {
+		keys[k] = k
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return order.less(m.worktrees[keys[i]], m.worktrees[keys[j]])
+	})
+
+	m.visible = make([]int, 0, len(keys))
+	m.matches = nil
+	for _, k := range keys {
+		if !m.statusFilter.keeps(m.worktrees[k]) {
+			continue
+		}
+		match := m.matchesFilter(m.worktrees[k])
+		if match || m.highlightOnly {
+			m.visible = append(m.visible, k)
+		}
+		if match && m.filter != "" {
+			m.matches = append(m.matches, len(m.visible)-1)
+		}
+	}
+
+	if m.cursor >= len(m.visible) {
+		m.cursor = len(m.visible) - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+
+	return m
+}
+
+// jumpToMatch moves the cursor to the next (or previous) matching
+// worktree, wrapping around at either end of the list.
+func (m model) jumpToMatch(forward bool) model {
+	if len(m.matches) == 0 {
+		return m
+	}
+
+	if forward {
+		for _, position := range m.matches {
+			if position > m.cursor {
+				m.cursor = position
+				return m
+			}
+		}
+		m.cursor = m.matches[0]
+		return m
+	}
+
+	for i := len(m.matches) - 1; i >= 0; i-- {
+		if m.matches[i] < m.cursor {
+			m.cursor = m.matches[i]
+			return m
+		}
+	}
+	m.cursor = m.matches[len(m.matches)-1]
+	return m
+}
+
+// jumpToDirty moves the cursor to the next worktree with uncommitted
+// changes, wrapping around at the end of the list. It tells whether
+// there was one to go to.
+func (m model) jumpToDirty() (model, bool) {
+	for step := 1; step <= len(m.visible); step++ {
+		position := (m.cursor + step) % len(m.visible)
+		if m.worktrees[m.visible[position]].Dirty {
+			m.cursor = position
+			return m, true
+		}
+	}
+
+	return m, false
+}
+
+// replaceWorktrees swaps in a freshly listed set of worktrees. The
+// cursor follows its worktree by path, since indices may have changed,
+// and selected worktrees that no longer exist are dropped.
+func (m model) replaceWorktrees(worktrees []worktree) model {
+	cursorPath := ""
+	if tree, ok := m.current(); ok {
+		cursorPath = tree.Path
+	}
+
+	m.worktrees = worktrees
+
+	selected := make(map[string]struct{}, len(m.selected))
+	for _, tree := range m.worktrees {
+		if m.isSelected(tree) {
+			selected[tree.Path] = struct{}{}
+		}
+	}
+	m.selected = selected
+
+	m = m.applyFilter()
+	for i, k := range m.visible {
+		if m.worktrees[k].Path == cursorPath {
+			m.cursor = i
+			break
+		}
+	}
+
+	return m
+}
+
+// switchRepo shows the repo step places away from the current one,
+// keeping the worktrees and the selection of the one it leaves.
+func (m model) switchRepo(step int) (model, tea.Cmd) {
+	m.repoStates[m.bareRepoPath] = repoState{
+		worktrees:     m.worktrees,
+		loaded:        m.loaded,
+		selected:      m.selected,
+		cursor:        m.cursor,
+		defaultBranch: m.defaultBranch,
+	}
+
+	current := slices.Index(m.repos, m.bareRepoPath)
+	next := (current + step + len(m.repos)) % len(m.repos)
+	m.bareRepoPath = m.repos[next]
+
+	state, ok := m.repoStates[m.bareRepoPath]
+	if !ok {
+		state.selected = make(map[string]struct{})
+	}
+	m.worktrees = state.worktrees
+	m.loaded = state.loaded
+	m.selected = state.selected
+	m.cursor = state.cursor
+	m.defaultBranch = state.defaultBranch
+	m.commits = make(map[string]commitInfo)
+	m.errMsg = ""
+	m = m.applyFilter()
+	m.isLoading = true
+
+	return m, tea.Batch(listTrees(m), loadDefaultBranch(m))
+}
+
+// startDelete asks to confirm deleting the selection, unless the main
+// worktree is part of it. Git won't remove that one anyway.
+func (m model) startDelete(action confirm) model {
+	m.errMsg = ""
+	if len(m.selected) == 0 {
+		return m
+	}
+
+	for _, tree := range selectedTrees(m) {
+		if tree.Main {
+			m.errMsg = fmt.Sprintf("%s is the main worktree and can't be deleted", tree.Name)
+			return m
+		}
+	}
+
+	m.confirm = action
+	return m
+}
+
+// needsConfirm tells whether the pending delete is big enough to ask
+// about, see ConfirmDeleteFrom. Uncommitted changes and locked
+// worktrees always get asked about, as a force delete would throw
+// them away. Unpushed commits are checked once loadUnpushed is done.
+func (m model) needsConfirm() bool {
+	from := m.config.ConfirmDeleteFrom
+	if from <= 0 {
+		from = defaultConfirmDeleteFrom
+	}
+
+	return len(m.selected) >= from || len(selectedDirtyNames(m)) > 0 || len(selectedLockedNames(m)) > 0
+}
+
+// runDelete deletes the selection and puts the delete options back
+// to what the config says for next time.
+func (m model) runDelete(force bool) (model, tea.Cmd) {
+	deleteCmd := deleteTrees(m, force)
+	m.deleteBranches = m.config.DeleteBranches
+	m.archive = m.config.ArchiveDir != ""
+	m.isLoading = true
+	return m, tea.Sequence(
+		deleteCmd,
+		listTrees(m),
+	)
+}
+
+// repo is the repo on screen, for the calls the worktree package handles.
+func (m model) repo() wt.Repo {
+	return wt.Repo{Git: m.gitPath, Path: m.bareRepoPath, Runner: m.runner}
+}
+
+// isCurrent tells whether tow was started from inside the worktree.
+func (m model) isCurrent(tree worktree) bool {
+	if m.cwd == "" {
+		return false
+	}
+
+	return m.cwd == tree.Path || strings.HasPrefix(m.cwd, tree.Path+string(filepath.Separator))
+}
+
+// setStatus shows a status message and schedules its removal.
+func (m model) setStatus(status string) (model, tea.Cmd) {
+	m.status = status
+	m.statusID++
+	id := m.statusID
+
+	return m, tea.Tick(statusTimeout, func(time.Time) tea.Msg {
+		return clearStatusMsg(id)
+	})
+}
+
+func (m model) startPrompt(p prompt, placeholder string) (model, tea.Cmd) {
+	m.prompt = p
+	m.input.Reset()
+	m.input.Placeholder = placeholder
+	return m, m.input.Focus()
+}
+
+func (m model) stopPrompt() model {
+	m.prompt = promptNone
+	m.newBranch = ""
+	m.branches = nil
+	m.branchPick = -1
+	m.completions = nil
+	m.promptTree = worktree{}
+	m.input.Blur()
+	m.input.Reset()
+	return m
+}
+
+// pickerSize is how many branches the picker shows at once.
+const pickerSize = 5
+
+// branchMatches are the known branches that contain what's been typed
+// so far, for the picker under the new branch prompt.
+func (m model) branchMatches() []string {
+	query := strings.ToLower(strings.TrimSpace(m.input.Value()))
+
+	var matches []string
+	for _, branch := range m.branches {
+		if strings.Contains(strings.ToLower(branch), query) {
+			matches = append(matches, branch)
+		}
+	}
+
+	return matches
+}
+
+// updatePicker moves through the branch picker. Reaching past the top
+// goes back to what was typed.
+func (m model) updatePicker(key string) model {
+	matches := m.branchMatches()
+
+	switch key {
+	case "up", "ctrl+p":
+		m.branchPick = max(m.branchPick-1, -1)
+	case "down", "ctrl+n":
+		m.branchPick = min(m.branchPick+1, min(len(matches), pickerSize)-1)
+	}
+
+	return m
+}
+
+// completeBranch fills in the first branch starting with what's been
+// typed. Pressing tab again goes on to the next one.
+func (m model) completeBranch() model {
+	if m.completions == nil {
+		prefix := m.input.Value()
+		for _, branch := range m.branches {
+			if strings.HasPrefix(branch, prefix) {
+				m.completions = append(m.completions, branch)
+			}
+		}
+		if len(m.completions) == 0 {
+			return m
+		}
+		m.completion = 0
+	} else {
+		m.completion = (m.completion + 1) % len(m.completions)
+	}
+
+	m.input.SetValue(m.completions[m.completion])
+	m.input.CursorEnd()
+	m.branchPick = -1
+
+	return m
+}
+
+// updatePrompt handles the keys while the input line is active.
+// Everything except enter and esc goes into the text input.
+func (m model) updatePrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.prompt == promptBranch || m.prompt == promptCheckout {
+		if msg.String() == "tab" {
+			return m.completeBranch(), nil
+		}
+		m.completions = nil
+	}
+
+	if m.prompt == promptBranch {
+		switch msg.String() {
+		case "up", "ctrl+p", "down", "ctrl+n":
+			return m.updatePicker(msg.String()), nil
+		}
+	}
+
+	switch msg.String() {
+
+	case "ctrl+c":
+		return m, tea.Quit
+
+	case "esc":
+		if m.prompt == promptFilter {
+			m.filter = ""
+			m = m.applyFilter()
+		}
+		return m.stopPrompt(), nil
+
+	case "enter":
+		value := strings.TrimSpace(m.input.Value())
+
+		switch m.prompt {
+		case promptFilter:
+			return m.stopPrompt(), nil
+
+		case promptBranch:
+			// A picked branch already exists, so there's no base to ask for.
+			if matches := m.branchMatches(); m.branchPick >= 0 && m.branchPick < len(matches) {
+				branch := matches[m.branchPick]
+				m = m.stopPrompt()
+				m.isLoading = true
+				return m, tea.Sequence(
+					mutating("add "+branch, addTree(m, branch, "")),
+					listTrees(m),
+				)
+			}
+			if value == "" {
+				return m.stopPrompt(), nil
+			}
+			m.newBranch = value
+			return m.startPrompt(promptBase, "HEAD")
+
+		case promptMove:
+			tree := m.promptTree
+			m = m.stopPrompt()
+			if value == "" || value == tree.Path {
+				return m, nil
+			}
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating("move "+tree.Path, moveTree(m, tree, value)),
+				listTrees(m),
+			)
+
+		case promptCheckout:
+			tree := m.promptTree
+			m = m.stopPrompt()
+			if value == "" || value == tree.Branch {
+				return m, nil
+			}
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating("checkout "+tree.Path, checkoutTree(m, tree, value)),
+				listTrees(m),
+			)
+
+		case promptRename:
+			tree := m.promptTree
+			m = m.stopPrompt()
+			if value == "" || value == tree.Branch {
+				return m, nil
+			}
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating("rename "+tree.Path, renameBranch(m, tree, value)),
+				listTrees(m),
+			)
+
+		case promptDetach:
+			m = m.stopPrompt()
+			if value == "" {
+				return m, nil
+			}
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating("add "+value, addDetachedTree(m, value)),
+				listTrees(m),
+			)
+
+		case promptPR:
+			m = m.stopPrompt()
+			if value == "" {
+				return m, nil
+			}
+			number, err := strconv.Atoi(strings.TrimPrefix(value, "#"))
+			if err != nil || number <= 0 {
+				m.errMsg = fmt.Sprintf("%q isn't a pull request number", value)
+				return m, nil
+			}
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating(fmt.Sprintf("add pr-%d", number), addPullRequestTree(m, number)),
+				listTrees(m),
+			)
+
+		case promptBase:
+			branch := m.newBranch
+			m = m.stopPrompt()
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating("add "+branch, addTree(m, branch, value)),
+				listTrees(m),
+			)
+		}
+	}
+
+	var cmd tea.Cmd
+	before := m.input.Value()
+	m.input, cmd = m.input.Update(msg)
+
+	// Typing narrows the picker, so the pick starts over.
+	if m.input.Value() != before {
+		m.branchPick = -1
+	}
+
+	if m.prompt == promptFilter {
+		m.filter = m.input.Value()
+		m = m.applyFilter()
+	}
+
+	return m, cmd
+}
+
+// updateConfirm waits for the answer to the pending question.
+// Only "y" runs the pending action, "n" and esc drop it.
+func (m model) updateConfirm(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+
+	case "ctrl+c":
+		return m, tea.Quit
+
+	case "y":
+		action := m.confirm
+		m.confirm = confirmNone
+		m.pruneable = nil
+		m.cleanable = nil
+		m.unpushed = nil
+		m.fileCounts = nil
+
+		switch action {
+		case confirmDelete, confirmForceDelete:
+			return m.runDelete(action == confirmForceDelete)
+
+		case confirmPrune:
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating("prune "+m.bareRepoPath, pruneTrees(m, false)),
+				listTrees(m),
+			)
+
+		case confirmClean:
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating("clean "+m.cleanTarget.Path, cleanTree(m, m.cleanTarget, false)),
+				listTrees(m),
+			)
+
+		case confirmMkdir:
+			add := mutating("mkdir "+m.missingDir, createDir(m.missingDir, m.pendingAdd))
+			m.missingDir = ""
+			m.pendingAdd = nil
+			m.isLoading = true
+			return m, tea.Sequence(
+				add,
+				listTrees(m),
+			)
+		}
+
+	case "b":
+		if m.confirm == confirmDelete || m.confirm == confirmForceDelete {
+			m.deleteBranches = !m.deleteBranches
+		}
+
+	// Archiving needs a directory, so it can only be turned off.
+	case "a":
+		if (m.confirm == confirmDelete || m.confirm == confirmForceDelete) && m.config.ArchiveDir != "" {
+			m.archive = !m.archive
+		}
+
+	case "n", "esc":
+		m.confirm = confirmNone
+		m.pruneable = nil
+		m.cleanable = nil
+		m.missingDir = ""
+		m.pendingAdd = nil
+		m.unpushed = nil
+		m.fileCounts = nil
+		m.deleteBranches = m.config.DeleteBranches
+		m.archive = m.config.ArchiveDir != ""
+	}
+
+	return m, nil
+}
+
+// updateInfo scrolls the info pane until it's closed.
+func (m model) updateInfo(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+
+	case "ctrl+c", "q":
+		return m, tea.Quit
+
+	case "i", "esc":
+		m.showInfo = false
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.info, cmd = m.info.Update(msg)
+
+	return m, cmd
+}
+
+// openInfo shows the info pane while its content loads.
+func (m model) openInfo(title string) model {
+	m.showInfo = true
+	m.infoTitle = title
+	m.info = viewport.New(m.width, infoHeight(m))
+	m.info.SetContent("Loading...")
+	return m
+}
+
+// infoHeight leaves room for the title and the key hints around
+// the pane, see getInfo.
+func infoHeight(m model) int {
+	return max(m.height-6, 1)
+}
+
+// updateHelp only lets the user close the help or quit.
+func (m model) updateHelp(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+
+	case "ctrl+c", "q":
+		return m, tea.Quit
+
+	case "?", "esc":
+		m.showHelp = false
+	}
+
+	return m, nil
+}
+
+// Update handles the message and then makes sure the details of the
+// worktree under the cursor are being loaded.
+func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	updated, cmd := m.update(msg)
+	next := updated.(model)
+
+	// Whatever started loading starts the spinner as well.
+	if next.isLoading && !m.isLoading {
+		cmd = tea.Batch(cmd, next.spinner.Tick)
+	}
+
+	// Errors come from all over the place, so they get their
+	// timeout here rather than where they're set.
+	if next.errMsg != "" && next.errMsg != m.errMsg {
+		next.errorID++
+		id := next.errorID
+		cmd = tea.Batch(cmd, tea.Tick(errorTimeout, func(time.Time) tea.Msg {
+			return clearErrorMsg(id)
+		}))
+	}
+
+	loadCmd := loadCommit(next)
+	sizeCmd := loadSizes(next)
+	authorCmd := loadAuthors(next)
+	if loadCmd == nil && sizeCmd == nil && authorCmd == nil {
+		return next, cmd
+	}
+
+	return next, tea.Batch(cmd, loadCmd, sizeCmd, authorCmd)
+}
+
+func (m model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if keyMsg, ok := msg.(tea.KeyMsg); ok {
+		if m.showHelp {
+			return m.updateHelp(keyMsg)
+		}
+		if m.showInfo {
+			return m.updateInfo(keyMsg)
+		}
+		if m.prompt != promptNone {
+			return m.updatePrompt(keyMsg)
+		}
+		if m.confirm != confirmNone {
+			return m.updateConfirm(keyMsg)
+		}
+	}
+
+	switch msg := msg.(type) {
+
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+		m.height = msg.Height
+		m.info.Width = msg.Width
+		m.info.Height = infoHeight(m)
+
+	case tea.MouseMsg:
+		return m.updateMouse(msg)
+
+	// An error also ends whatever was in progress.
+	case actionMsg:
+		if m.failed == nil {
+			m.failed = make(map[string]bool)
+		}
+		// A worktree waiting for its directory hasn't been added yet.
+		switch msg.msg.(type) {
+		case errMsg:
+			m.failed[msg.key] = true
+		case mkdirMsg:
+		default:
+			delete(m.failed, msg.key)
+		}
+		return m.update(msg.msg)
+
+	case errMsg:
+		m.errMsg = msg.msg
+		m.status = ""
+		m.isLoading = false
+		// A list that failed isn't coming, the error says why.
+		m.loaded = true
+
+	// The spinner stops ticking once nothing is loading.
+	case spinner.TickMsg:
+		if !m.isLoading {
+			break
+		}
+		var cmd tea.Cmd
+		m.spinner, cmd = m.spinner.Update(msg)
+		return m, cmd
+
+	case listMsg:
+		if msg.repo != m.bareRepoPath {
+			break
+		}
+		m = m.replaceWorktrees(msg.worktrees)
+		m.commits = make(map[string]commitInfo)
+		m.isLoading = false
+		m.loaded = true
+
+		missing := 0
+		for _, tree := range msg.worktrees {
+			if tree.Prunable {
+				missing++
+			}
+		}
+		if missing > 0 {
+			return m.setStatus(fmt.Sprintf(
+				"%d %s missing, press p to prune",
+				missing, plural(missing, "worktree is", "worktrees are")))
+		}
+
+	// Missing worktrees say more than the list being refreshed.
+	case refreshMsg:
+		statusID := m.statusID
+		next, cmd := m.update(listMsg(msg))
+		m = next.(model)
+		if msg.repo != m.bareRepoPath || m.statusID != statusID {
+			return m, cmd
+		}
+		m, statusCmd := m.setStatus("List refreshed")
+		return m, tea.Batch(cmd, statusCmd)
+
+	case commitMsg:
+		m.commits[msg.path] = msg.info
+
+	case sizeMsg:
+		m.sizes[msg.path] = msg.info
+
+	case authorMsg:
+		m.authors[msg.head] = msg.name
+
+	case treeMsg:
+		m.isLoading = false
+		worktrees := slices.Clone(m.worktrees)
+		for i, tree := range worktrees {
+			if tree.Path == msg.Path {
+				worktrees[i] = worktree(msg)
+			}
+		}
+		m = m.replaceWorktrees(worktrees)
+		delete(m.commits, msg.Path)
+		delete(m.sizes, msg.Path)
+		return m.setStatus(fmt.Sprintf("Refreshed %s", msg.Name))
+
+	case unpushedMsg:
+		if m.pendingDelete != confirmNone {
+			action := m.pendingDelete
+			m.pendingDelete = confirmNone
+			// The selection may have changed in the meantime.
+			if len(m.selected) == 0 {
+				break
+			}
+			if len(msg) == 0 && !m.needsConfirm() {
+				return m.runDelete(action == confirmForceDelete)
+			}
+			m = m.startDelete(action)
+			m.unpushed = msg
+			return m, loadFileCounts(m)
+		}
+		if m.confirm == confirmDelete || m.confirm == confirmForceDelete {
+			m.unpushed = msg
+		}
+
+	case fileCountMsg:
+		if m.confirm == confirmDelete || m.confirm == confirmForceDelete {
+			m.fileCounts = msg
+		}
+
+	case branchesMsg:
+		if msg.repo == m.bareRepoPath && (m.prompt == promptBranch || m.prompt == promptCheckout) {
+			m.branches = msg.branches
+		}
+
+	case defaultBranchMsg:
+		if msg.repo == m.bareRepoPath {
+			m.defaultBranch = msg.branch
+		}
+
+	// After delete operations ran, we need to update
+	// the model accordingly otherwise the view will break.
+	case deleteMsg:
+		deleted := make(map[string]bool, len(msg.deleted))
+		for _, path := range msg.deleted {
+			deleted[path] = true
+			delete(m.selected, path)
+		}
+
+		remaining := make([]worktree, 0, len(m.worktrees))
+		for _, tree := range m.worktrees {
+			if !deleted[tree.Path] {
+				remaining = append(remaining, tree)
+			}
+		}
+		m.worktrees = remaining
+		m = m.applyFilter()
+
+		if m.failed == nil {
+			m.failed = make(map[string]bool)
+		}
+		for _, path := range msg.deleted {
+			delete(m.failed, "delete "+path)
+		}
+		for _, path := range msg.failedPaths {
+			m.failed["delete "+path] = true
+		}
+
+		// Whatever failed stays selected, ready for another go.
+		if len(msg.failures) > 0 {
+			m.errMsg = fmt.Sprintf(
+				"Deleted %d, failed %d (%s)",
+				len(msg.deleted), len(msg.failures), strings.Join(msg.failures, "; "))
+			return m, nil
+		}
+
+		status := fmt.Sprintf("Removed %d %s", len(msg.deleted), plural(len(msg.deleted), "worktree", "worktrees"))
+		if len(msg.archived) > 0 {
+			status += ", archived to " + filepath.Dir(msg.archived[0])
+		}
+		if len(msg.trees) > 0 {
+			m.lastDelete = msg
+			status += ", u to undo"
+		}
+		return m.setStatus(status)
+
+	case restoreMsg:
+		return m.setStatus(fmt.Sprintf(
+			"Restored %d %s, uncommitted changes couldn't be brought back",
+			int(msg), plural(int(msg), "worktree", "worktrees")))
+
+	case addMsg:
+		return m.setStatus("Worktree created")
+
+	case moveMsg:
+		return m.setStatus("Worktree moved")
+
+	case checkoutMsg:
+		return m.setStatus(string(msg))
+
+	case renameMsg:
+		return m.setStatus(string(msg))
+
+	case syncMsg:
+		return m.setStatus(string(msg))
+
+	case infoMsg:
+		if m.showInfo && msg.title == m.infoTitle {
+			m.info.SetContent(msg.content)
+		}
+
+	// The editor may well have changed the worktree.
+	case editorMsg:
+		if msg.err != nil {
+			m.errMsg = fmt.Sprintf("editor failed: %v", msg.err)
+		}
+		m.isLoading = true
+		return m, listTrees(m)
+
+	case pruneMsg:
+		switch {
+		case msg.dryRun && len(msg.entries) == 0:
+			return m.setStatus("Nothing to prune")
+		case msg.dryRun:
+			m.confirm = confirmPrune
+			m.pruneable = msg.entries
+		default:
+			return m.setStatus(fmt.Sprintf("Pruned %d stale %s", len(msg.entries), plural(len(msg.entries), "entry", "entries")))
+		}
+
+	case cleanMsg:
+		switch {
+		case msg.dryRun && len(msg.entries) == 0:
+			return m.setStatus(fmt.Sprintf("Nothing to clean in %s", msg.tree.Name))
+		case msg.dryRun:
+			m.confirm = confirmClean
+			m.cleanable = msg.entries
+			m.cleanTarget = msg.tree
+		default:
+			// The size column measures the worktree again.
+			delete(m.sizes, msg.tree.Path)
+			return m.setStatus(fmt.Sprintf(
+				"Removed %d %s from %s",
+				len(msg.entries), plural(len(msg.entries), "path", "paths"), msg.tree.Name))
+		}
+
+	case mkdirMsg:
+		m.confirm = confirmMkdir
+		m.missingDir = msg.dir
+		m.pendingAdd = msg.add
+
+	case statusMsg:
+		return m.setStatus(string(msg))
+
+	// Only the tick of the latest status clears it, so an
+	// older tick can't cut a newer message short.
+	case clearStatusMsg:
+		if int(msg) == m.statusID {
+			m.status = ""
+		}
+
+	// Same for errors, a newer one gets its full time on screen.
+	case clearErrorMsg:
+		if int(msg) == m.errorID {
+			m.errMsg = ""
+		}
+
+	case tea.KeyMsg:
+		key := msg.String()
+		if alias, ok := m.config.Keys[key]; ok {
+			key = alias
+		}
+
+		if m.keyDisabled(key) {
+			m.errMsg = fmt.Sprintf("%s is turned off in read-only mode", key)
+			return m, nil
+		}
+
+		switch key {
+
+		case "ctrl+r":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			m.isLoading = true
+			return m, refreshTree(m, tree)
+
+		case "r":
+			m.errMsg = ""
+			m.sizes = make(map[string]sizeInfo)
+			m.isLoading = true
+			return m, refreshTrees(m)
+
+		// While searching, n and N jump between matches like in vim.
+		case "n", "N":
+			m.errMsg = ""
+			if m.filter != "" {
+				m = m.jumpToMatch(key == "n")
+				break
+			}
+			if key == "n" {
+				m, cmd := m.startPrompt(promptBranch, "branch name")
+				m.branchPick = -1
+				return m, tea.Batch(cmd, loadBranches(m))
+			}
+			return m.startPrompt(promptDetach, "commit, tag or branch")
+
+		case "#":
+			m.errMsg = ""
+			return m.startPrompt(promptPR, "pull request number")
+
+		case "f":
+			m.errMsg = ""
+			m.highlightOnly = !m.highlightOnly
+			m = m.applyFilter()
+
+		// * is what marks dirty worktrees in the table.
+		case "*":
+			m.errMsg = ""
+			var found bool
+			if m, found = m.jumpToDirty(); !found {
+				return m.setStatus("No worktrees with uncommitted changes")
+			}
+
+		case "v":
+			m.errMsg = ""
+			m.statusFilter = (m.statusFilter + 1) % 3
+			m = m.applyFilter()
+
+		case "m":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			m, cmd := m.startPrompt(promptMove, "")
+			m.promptTree = tree
+			m.input.SetValue(tree.Path)
+			return m, cmd
+
+		case "c":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			m, cmd := m.startPrompt(promptCheckout, "branch name")
+			m.promptTree = tree
+			return m, tea.Batch(cmd, loadBranches(m))
+
+		case "R":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			if tree.Detached {
+				m.errMsg = fmt.Sprintf("%s is detached, there's no branch to rename", tree.Name)
+				break
+			}
+			m, cmd := m.startPrompt(promptRename, "new branch name")
+			m.promptTree = tree
+			m.input.SetValue(tree.Branch)
+			return m, cmd
+
+		case "/":
+			m.errMsg = ""
+			filter := m.filter
+			m, cmd := m.startPrompt(promptFilter, "name or branch")
+			m.input.SetValue(filter)
+			return m, cmd
+
+		// Start over, say after a batch that went wrong.
+		case "esc":
+			m.errMsg = ""
+			m.filter = ""
+			m.statusFilter = statusAll
+			m.selected = make(map[string]struct{})
+			m = m.applyFilter()
+			m.cursor = 0
+
+		case "s":
+			m.errMsg = ""
+			m.sortIndex = (m.sortIndex + 1) % len(sortOrders)
+			m = m.applyFilter()
+
+		case "d", "D":
+			action := confirmDelete
+			if key == "D" {
+				action = confirmForceDelete
+			}
+			m = m.startDelete(action)
+			if m.confirm == confirmNone {
+				break
+			}
+			// Unpushed commits still get asked about, so a delete
+			// without confirmation waits for them to be counted.
+			if !m.needsConfirm() {
+				m.confirm = confirmNone
+				m.pendingDelete = action
+				return m, loadUnpushed(m)
+			}
+			return m, tea.Batch(loadUnpushed(m), loadFileCounts(m))
+
+		case "p":
+			m.errMsg = ""
+			return m, pruneTrees(m, true)
+
+		case "W":
+			m.errMsg = ""
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating("repair "+m.bareRepoPath, repairTrees(m)),
+				listTrees(m),
+			)
+
+		// Cleaning always shows what goes first and asks before
+		// removing anything.
+		case "X":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			return m, cleanTree(m, tree, true)
+
+		case "ctrl+c", "q":
+			return m, tea.Quit
+
+		case "?":
+			m.showHelp = true
+
+		case "t":
+			m.absoluteTime = !m.absoluteTime
+
+		case "z":
+			m.columns["size"] = !m.columns["size"]
+
+		case "F", "P":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			pull := key == "P"
+			if pull && tree.Detached {
+				m.errMsg = fmt.Sprintf("%s is detached, there's no branch to pull", tree.Name)
+				break
+			}
+
+			// The status stays up until the command is done, a new
+			// status id keeps earlier timeouts from clearing it.
+			m.status = fmt.Sprintf("Fetching %s...", tree.Name)
+			if pull {
+				m.status = fmt.Sprintf("Pulling %s...", tree.Name)
+			}
+			m.statusID++
+
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating(key+" "+tree.Path, syncTree(m, tree, pull)),
+				listTrees(m),
+			)
+
+		case "tab", "shift+tab":
+			if len(m.repos) < 2 {
+				break
+			}
+			step := 1
+			if key == "shift+tab" {
+				step = -1
+			}
+			return m.switchRepo(step)
+
+		// Only the visible worktrees get selected, so an active
+		// filter limits what "a" picks up.
+		case "a":
+			m.errMsg = ""
+			for _, k := range m.visible {
+				m.selected[m.worktrees[k].Path] = struct{}{}
+			}
+
+		case "A":
+			m.errMsg = ""
+			m.selected = make(map[string]struct{})
+
+		case "L", "U":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating("lock "+tree.Path, lockTree(m, tree, key == "L")),
+				listTrees(m),
+			)
+
+		case "u":
+			m.errMsg = ""
+			if len(m.lastDelete.trees) == 0 {
+				m.errMsg = "nothing to undo"
+				break
+			}
+			last := m.lastDelete
+			m.lastDelete = deleteMsg{}
+			m.isLoading = true
+			return m, tea.Sequence(
+				mutating("undo "+last.repo, restoreTrees(m, last)),
+				listTrees(m),
+			)
+
+		// Quit and let main print the path of the worktree under
+		// the cursor, so a shell function can cd into it.
+		case "o":
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			m.chosenPath = tree.Path
+			return m, tea.Quit
+
+		case "i":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			m = m.openInfo(infoTitle(tree))
+			return m, loadInfo(m, tree)
+
+		case "C":
+			m.errMsg = ""
+			trees := selectedTrees(m)
+			if len(trees) != 2 {
+				m.errMsg = "select exactly two worktrees to compare"
+				break
+			}
+			m = m.openInfo(compareTitle(trees[0], trees[1]))
+			return m, compareTrees(m, trees[0], trees[1])
+
+		case "O":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			return m, revealTree(tree)
+
+		case "e":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			return m, openEditor(m, tree)
+
+		case "up", "k":
+			m.errMsg = ""
+			switch {
+			case m.cursor > 0:
+				m.cursor--
+			case m.config.WrapNavigation:
+				m.cursor = max(len(m.visible)-1, 0)
+			}
+
+		case "down", "j":
+			m.errMsg = ""
+			switch {
+			case m.cursor < len(m.visible)-1:
+				m.cursor++
+			case m.config.WrapNavigation:
+				m.cursor = 0
+			}
+
+		case "y":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			return m, copyToClipboard(tree.Path, "path")
+
+		case "Y":
+			m.errMsg = ""
+			tree, ok := m.current()
+			if !ok {
+				break
+			}
+			if tree.Detached {
+				m.errMsg = fmt.Sprintf("%s is detached, there's no branch to copy", tree.Name)
+				break
+			}
+			return m, copyToClipboard(tree.Branch, "branch")
+
+		case "pgup", "ctrl+u":
+			m.errMsg = ""
+			m = m.moveCursor(-pageSize(m))
+
+		case "pgdown", "ctrl+d":
+			m.errMsg = ""
+			m = m.moveCursor(pageSize(m))
+
+		case "home", "g":
+			m.errMsg = ""
+			m = m.moveCursor(-len(m.visible))
+
+		case "end", "G":
+			m.errMsg = ""
+			m = m.moveCursor(len(m.visible))
+
+		// The "enter" key and the spacebar (a literal space) toggle
+		// the selected state for the item that the cursor is pointing at.
+		case "enter", " ":
+			m.errMsg = ""
+			m = m.toggleSelected()
+		}
+	}
+
+	return m, nil
+}
+
+// updateMouse moves the cursor to the clicked row, toggles the
+// selection when the checkbox is clicked and scrolls with the wheel.
+func (m model) updateMouse(msg tea.MouseMsg) (tea.Model, tea.Cmd) {
+	if m.showInfo {
+		var cmd tea.Cmd
+		m.info, cmd = m.info.Update(msg)
+		return m, cmd
+	}
+
+	if m.showHelp || m.prompt != promptNone || m.confirm != confirmNone {
+		return m, nil
+	}
+
+	switch msg.Type {
+
+	case tea.MouseWheelUp:
+		m = m.moveCursor(-1)
+
+	case tea.MouseWheelDown:
+		m = m.moveCursor(1)
+
+	case tea.MouseLeft:
+		start, end := tableWindow(m)
+		row := start + msg.Y - firstRowLine(m)
+		if row < start || row >= end {
+			break
+		}
+		m.errMsg = ""
+		m.cursor = row
+		// The checkbox is the "[ ]" right after the cursor column.
+		if msg.X >= 2 && msg.X <= 4 {
+			m = m.toggleSelected()
+		}
+	}
+
+	return m, nil
+}
+
+// toggleSelected selects or unselects the worktree under the cursor.
+func (m model) toggleSelected() model {
+	tree, ok := m.current()
+	if !ok {
+		return m
+	}
+
+	if m.isSelected(tree) {
+		delete(m.selected, tree.Path)
+	} else {
+		m.selected[tree.Path] = struct{}{}
+	}
+
+	return m
+}
+
+func getHeader(m model) string {
+	current := m.cursor + 1
+	if len(m.visible) == 0 {
+		current = 0
+	}
+
+	// Filters hide worktrees, so the count says how many there are.
+	total := fmt.Sprint(len(m.visible))
+	if len(m.visible) < len(m.worktrees) {
+		total = fmt.Sprintf("%d (of %d)", len(m.visible), len(m.worktrees))
+	}
+
+	selected := ""
+	if len(m.selected) > 0 {
+		selected = fmt.Sprintf(" selected: %d", len(m.selected))
+	}
+
+	filter := ""
+	if m.filter != "" {
+		kind := "filter"
+		if m.highlightOnly {
+			kind = "search"
+		}
+		if m.filterRegexp != nil {
+			kind += " (regex)"
+		}
+		filter = fmt.Sprintf(" %s: %s", kind, m.filter)
+		if m.highlightOnly {
+			filter += fmt.Sprintf(" (%d %s)", len(m.matches), plural(len(m.matches), "match", "matches"))
+		}
+	}
+
+	if m.statusFilter != statusAll {
+		filter += fmt.Sprintf(" showing: %s", m.statusFilter)
+	}
+
+	repo := abbreviateHome(m.bareRepoPath)
+	if m.defaultBranch != "" {
+		repo = fmt.Sprintf("%s (%s)", repo, m.defaultBranch)
+	}
+	if len(m.repos) > 1 {
+		repo = fmt.Sprintf("%s, repo %d/%d", repo, slices.Index(m.repos, m.bareRepoPath)+1, len(m.repos))
+	}
+
+	mode := ""
+	if m.dryRun {
+		mode += " DRY RUN"
+	}
+	if m.readOnly {
+		mode += " READ-ONLY"
+	}
+
+	loading := ""
+	if m.isLoading {
+		loading = " " + m.spinner.View()
+	}
+
+	return fmt.Sprintf(
+		"\nWorktrees of %s: [%d/%s]%s sort: %s%s%s%s\n\n",
+		repo, current, total, selected, sortOrders[m.sortIndex], filter, mode, loading)
+}
+
+// abbreviateHome replaces the home directory at the start of the path
+// with ~ to keep the header short.
+func abbreviateHome(path string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return path
+	}
+
+	if path == home {
+		return "~"
+	}
+	if rest, ok := strings.CutPrefix(path, home+string(filepath.Separator)); ok {
+		return filepath.Join("~", rest)
+	}
+
+	return path
+}
+
+// shortHead abbreviates a commit hash the way git log --oneline does.
+func shortHead(head string) string {
+	if len(head) > 7 {
+		return head[:7]
+	}
+
+	return head
+}
+
+// branchLabel is what gets shown in the branch column. Detached
+// worktrees have no branch, so they show the commit they sit on.
+func branchLabel(tree worktree) string {
+	if tree.Detached {
+		return fmt.Sprintf("(detached at %s)", shortHead(tree.Head))
+	}
+
+	return tree.Branch
+}
+
+func getLongestLen(m model) int {
+	result := 16 // length of a timestamp like 2000-10-10 10:10
+	for _, tree := range m.worktrees {
+		if len(tree.Name) > result {
+			result = len(tree.Name)
+		}
+
+		if m.columns["branch"] && len(branchLabel(tree)) > result {
+			result = len(branchLabel(tree))
+		}
+	}
+
+	return result
+}
+
+// statusFlags sums up what's special about the worktree for the
+// status column.
+func statusFlags(tree worktree) string {
+	var flags []string
+	if tree.Main {
+		flags = append(flags, "main")
+	}
+	if tree.Prunable {
+		flags = append(flags, "(missing)")
+	}
+	if tree.Dirty {
+		flags = append(flags, "* dirty")
+	}
+	if tree.Locked {
+		flags = append(flags, "locked")
+	}
+
+	return strings.Join(flags, " ")
+}
+
+// minCellWidth keeps squeezed columns wide enough to tell rows apart.
+const minCellWidth = 6
+
+// columnWidths sizes the name, branch and modified columns. They're
+// all as wide as the longest value, unless that doesn't fit the
+// terminal. Then the time keeps its room and name and branch share
+// what's left, to be cut short with an ellipsis.
+func columnWidths(m model) (name int, branch int, modified int) {
+	maxLen := getLongestLen(m)
+	name, branch, modified = maxLen, maxLen, maxLen
+
+	// The cursor, checkbox and current marker.
+	fixed := 8
+	if m.columns["head"] {
+		fixed += 2 + 7
+	}
+	if m.columns["author"] {
+		fixed += 2 + authorWidth(m)
+	}
+	if m.columns["size"] {
+		fixed += 2 + 8
+	}
+	if m.columns["status"] {
+		longest := 0
+		for _, tree := range m.worktrees {
+			longest = max(longest, len(statusFlags(tree)))
+		}
+		fixed += 2 + max(longest, len("Status"))
+	}
+
+	width := fixed + name
+	if m.columns["branch"] {
+		width += 2 + branch
+	}
+	if m.columns["modified"] {
+		width += 2 + modified
+	}
+	if m.width <= 0 || width <= m.width {
+		return name, branch, modified
+	}
+
+	room := m.width - fixed
+	if m.columns["modified"] {
+		// Long enough for an absolute time like 2000-10-10 10:10.
+		modified = 16
+		room -= 2 + modified
+	}
+	if m.columns["branch"] {
+		room -= 2
+		name = max(room/2, minCellWidth)
+		branch = max(room-room/2, minCellWidth)
+		return name, branch, modified
+	}
+
+	return max(room, minCellWidth), branch, modified
+}
+
+// maxAuthorWidth keeps long names from pushing the other columns off
+// the screen.
+const maxAuthorWidth = 16
+
+// authorWidth fits the longest author name loaded so far.
+func authorWidth(m model) int {
+	width := len("Author")
+	for _, tree := range m.worktrees {
+		width = max(width, len(m.authors[tree.Head]))
+	}
+
+	return min(width, maxAuthorWidth)
+}
+
+// truncate cuts s down to width characters, ending with an ellipsis
+// when anything was cut.
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	if width <= 1 {
+		return "…"
+	}
+
+	return string(runes[:width-1]) + "…"
+}
+
+func formatTime(m model, t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+
+	if m.absoluteTime {
+		return t.Format("2006-01-02 15:04")
+	}
+
+	return relativeTime(t, time.Now())
+}
+
+var (
+	cursorStyle   = lipgloss.NewStyle().Reverse(true)
+	selectedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("6")).Bold(true)
+	matchStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("3"))
+	staleStyle    = lipgloss.NewStyle().Faint(true)
 )
 
-type worktree struct {
-	name       string
-	head       string
-	branch     string
-	modifiedAt string
+// disableStyles drops all styling, for NO_COLOR and --no-color. The
+// cursor and the checkboxes still show what's what.
+func disableStyles() {
+	cursorStyle = lipgloss.NewStyle()
+	selectedStyle = lipgloss.NewStyle()
+	matchStyle = lipgloss.NewStyle()
+	staleStyle = lipgloss.NewStyle()
+}
+
+// isStale tells whether the worktree hasn't been touched for longer
+// than the configured number of days.
+func (m model) isStale(tree worktree, now time.Time) bool {
+	days := m.config.StaleAfterDays
+	if days == 0 {
+		days = defaultStaleAfterDays
+	}
+	if days < 0 || tree.ModifiedAt.IsZero() {
+		return false
+	}
+
+	return now.Sub(tree.ModifiedAt) > time.Duration(days)*24*time.Hour
+}
+
+// pageSize is how many worktree rows fit on the screen: whatever the
+// rest of the view leaves over. Besides the rows, the table has its
+// column titles and the two "more" markers.
+func pageSize(m model) int {
+	rest := getHeader(m) + getMessages(m) + getDetails(m) + getFooter(m)
+	// The view ends with a newline, and bubbletea counts the empty
+	// line after it too.
+	reserved := strings.Count(rest, "\n") + 1 + 3
+
+	return max(m.height-reserved, 1)
+}
+
+// moveCursor moves the cursor by delta rows, stopping at either end.
+func (m model) moveCursor(delta int) model {
+	m.cursor = min(max(m.cursor+delta, 0), max(len(m.visible)-1, 0))
+	return m
+}
+
+// tableWindow returns the range of visible rows that fit on the
+// screen, scrolled so the cursor stays in view.
+func tableWindow(m model) (int, int) {
+	dataRows := pageSize(m)
+	start := 0
+	end := len(m.visible)
+
+	if end > 0 && dataRows < len(m.visible) {
+		end = dataRows
+		if m.cursor >= dataRows {
+			offset := (m.cursor + 1) - dataRows
+			if offset > 0 {
+				start = start + offset
+				end = start + dataRows
+			}
+		}
+	}
+
+	return start, end
+}
+
+// firstRowLine is the screen line of the first worktree row, below
+// the header, the messages, the column titles and the "more" marker.
+func firstRowLine(m model) int {
+	return strings.Count(getHeader(m)+getMessages(m), "\n") + 2
+}
+
+func getTable(m model) string {
+	var tabStrings strings.Builder
+
+	start, end := tableWindow(m)
+
+	nameWidth, branchWidth, modifiedWidth := columnWidths(m)
+
+	// cells lines up the columns that are turned on. The status
+	// column is last and isn't padded, so nothing trails the row.
+	authorsWidth := authorWidth(m)
+
+	cells := func(name, branch, head, author, modified, size, status string) string {
+		row := []string{fmt.Sprintf("%-*s", nameWidth, truncate(name, nameWidth))}
+		if m.columns["branch"] {
+			row = append(row, fmt.Sprintf("%-*s", branchWidth, truncate(branch, branchWidth)))
+		}
+		if m.columns["head"] {
+			row = append(row, fmt.Sprintf("%-7s", head))
+		}
+		if m.columns["author"] {
+			row = append(row, fmt.Sprintf("%-*s", authorsWidth, truncate(author, authorsWidth)))
+		}
+		if m.columns["modified"] {
+			row = append(row, fmt.Sprintf("%-*s", modifiedWidth, truncate(modified, modifiedWidth)))
+		}
+		if m.columns["size"] {
+			row = append(row, fmt.Sprintf("%-8s", size))
+		}
+		if m.columns["status"] {
+			row = append(row, status)
+		}
+		return strings.TrimRight(strings.Join(row, "  "), " ")
+	}
+
+	// Render table headers
+	tabStrings.WriteString(fmt.Sprintf(
+		"%-7s %s\n",
+		"",
+		cells("Worktree", "Branch", "Head", "Author", "Modified at", "Size", "Status")))
+
+	if len(m.visible) == 0 {
+		// Until the first list comes in, an empty table doesn't
+		// mean there are no worktrees.
+		empty := "No worktrees found"
+		switch {
+		case !m.loaded:
+			empty = "Loading worktrees..."
+		case len(m.worktrees) > 0:
+			empty = "No worktrees match the filter"
+		}
+		tabStrings.WriteString(fmt.Sprintf("\n        %s\n\n", empty))
+		return tabStrings.String()
+	}
+
+	// The markers always take their line, so the table
+	// doesn't shift when scrolling reaches either end.
+	tabStrings.WriteString(getMoreMarker(start, "above"))
+
+	for i := start; i < end; i++ {
+		k := m.visible[i]
+		worktree := m.worktrees[k]
+
+		// Is the cursor pointing at this choice?
+		cursor := " " // no cursor
+		if m.cursor == i {
+			cursor = ">" // cursor!
+		}
+
+		// Is this choice selected?
+		checked := " " // not selected
+		if m.isSelected(worktree) {
+			checked = "x" // selected!
+		}
+
+		// Is it where tow was started from?
+		current := " "
+		if m.isCurrent(worktree) {
+			current = "●"
+		}
+
+		status := statusFlags(worktree)
+
+		size := "..."
+		if info := m.sizes[worktree.Path]; info.loaded {
+			size = humanSize(info.bytes)
+		} else if worktree.Prunable {
+			size = "-"
+		}
+
+		author := "..."
+		if name := m.authors[worktree.Head]; name != "" {
+			author = name
+		} else if worktree.Head == "" || worktree.Prunable {
+			author = "-"
+		}
+
+		// Render the row. Styling wraps the padded text, so the
+		// escape codes don't throw off the column widths.
+		row := fmt.Sprintf(
+			"%s [%s] %s %s",
+			cursor, checked, current,
+			cells(worktree.Name, branchLabel(worktree), shortHead(worktree.Head), author, formatTime(m, worktree.ModifiedAt), size, status))
+
+		style := lipgloss.NewStyle()
+		if m.isStale(worktree, time.Now()) {
+			style = staleStyle
+		}
+		if m.highlightOnly && m.filter != "" && m.matchesFilter(worktree) {
+			style = matchStyle
+		}
+		if checked == "x" {
+			style = selectedStyle
+		}
+		if m.cursor == i {
+			style = style.Copy().Inherit(cursorStyle)
+		}
+
+		tabStrings.WriteString(style.Render(row))
+		tabStrings.WriteString("\n")
+	}
+
+	tabStrings.WriteString(getMoreMarker(len(m.visible)-end, "below"))
+
+	return tabStrings.String()
+}
+
+func getMoreMarker(count int, where string) string {
+	if count <= 0 {
+		return "\n"
+	}
+
+	return fmt.Sprintf("        ... %d more %s\n", count, where)
+}
+
+// selectedTrees returns the selected worktrees in list order.
+func selectedTrees(m model) []worktree {
+	var trees []worktree
+	for _, tree := range m.worktrees {
+		if m.isSelected(tree) {
+			trees = append(trees, tree)
+		}
+	}
+
+	return trees
+}
+
+func selectedDirtyNames(m model) []string {
+	var names []string
+	for _, tree := range selectedTrees(m) {
+		if tree.Dirty {
+			names = append(names, tree.Name)
+		}
+	}
+
+	return names
+}
+
+func selectedLockedNames(m model) []string {
+	var names []string
+	for _, tree := range selectedTrees(m) {
+		if tree.Locked {
+			names = append(names, tree.Name)
+		}
+	}
+
+	return names
+}
+
+func plural(n int, one string, many string) string {
+	if n == 1 {
+		return one
+	}
+
+	return many
+}
+
+func getPruneConfirmation(m model) string {
+	return fmt.Sprintf(
+		"\nPrune %d stale %s (%s)? (y/n)\n",
+		len(m.pruneable), plural(len(m.pruneable), "entry", "entries"),
+		strings.Join(m.pruneable, ", "))
+}
+
+func getCleanConfirmation(m model) string {
+	shown := m.cleanable
+	more := ""
+	if len(shown) > maxConfirmList {
+		shown = shown[:maxConfirmList]
+		more = fmt.Sprintf("  ...and %d more\n", len(m.cleanable)-maxConfirmList)
+	}
+
+	return fmt.Sprintf(
+		"\nRemoves from %s:\n  %s\n%s\nClean %d %s out of %s? (y/n)\n",
+		abbreviateHome(m.cleanTarget.Path), strings.Join(shown, "\n  "), more,
+		len(m.cleanable), plural(len(m.cleanable), "path", "paths"), m.cleanTarget.Name)
+}
+
+func getConfirmation(m model) string {
+	if m.confirm == confirmPrune {
+		return getPruneConfirmation(m)
+	}
+	if m.confirm == confirmClean {
+		return getCleanConfirmation(m)
+	}
+	if m.confirm == confirmMkdir {
+		return fmt.Sprintf("\n%s doesn't exist, create it for the new worktree? (y/n)\n", m.missingDir)
+	}
+
+	forceDelete := m.confirm == confirmForceDelete
+
+	action := "Delete"
+	if forceDelete {
+		action = "Force delete"
+	}
+
+	noun := plural(len(m.selected), "worktree", "worktrees")
+
+	warning := ""
+	if dirty := selectedDirtyNames(m); len(dirty) > 0 {
+		warning = fmt.Sprintf(
+			"\nWARNING: uncommitted changes in %s\n",
+			strings.Join(dirty, ", "))
+	}
+
+	for _, tree := range selectedTrees(m) {
+		count, ok := m.unpushed[tree.Path]
+		if !ok {
+			continue
+		}
+
+		what := "branch " + tree.Branch
+		if tree.Detached {
+			what = tree.Name
+		}
+		warning += fmt.Sprintf(
+			"\nWARNING: %s has %d unpushed %s\n",
+			what, count, plural(count, "commit", "commits"))
+	}
+
+	if locked := selectedLockedNames(m); len(locked) > 0 {
+		if forceDelete {
+			warning += fmt.Sprintf(
+				"\nWARNING: locked worktrees will be removed anyway: %s\n",
+				strings.Join(locked, ", "))
+		} else {
+			warning += fmt.Sprintf(
+				"\nWARNING: locked worktrees need force delete (D): %s\n",
+				strings.Join(locked, ", "))
+		}
+	}
+
+	warning += deleteList(m)
+
+	branches := "keep"
+	if m.deleteBranches {
+		branches = "delete"
+		if forceDelete {
+			branches = "force delete"
+		}
+	}
+
+	archive := ""
+	if m.config.ArchiveDir != "" {
+		archive = ", a: archive first"
+		if !m.archive {
+			archive = ", a: don't archive"
+		}
+	}
+
+	return fmt.Sprintf(
+		"%s\n%s %d %s? (y/n, b: %s branches%s)\n",
+		warning,
+		action, len(m.selected), noun,
+		branches, archive)
+}
+
+// maxConfirmList is how many paths a confirmation lists before it
+// only says how many more there are.
+const maxConfirmList = 8
+
+// deleteList spells out which directories a delete removes, so a
+// mis-selection gets noticed in time. Git deletes everything in them,
+// untracked and ignored files included, so it says how much that is.
+func deleteList(m model) string {
+	trees := selectedTrees(m)
+
+	nameWidth := 0
+	for _, tree := range trees {
+		nameWidth = max(nameWidth, len(tree.Name))
+	}
+
+	var list strings.Builder
+	list.WriteString("\nRemoves from disk:\n")
+
+	for i, tree := range trees {
+		if i == maxConfirmList {
+			fmt.Fprintf(&list, "  ...and %d more\n", len(trees)-i)
+			break
+		}
+
+		files := ""
+		if count, ok := m.fileCounts[tree.Path]; ok {
+			files = fmt.Sprintf(" (%d %s)", count, plural(count, "file", "files"))
+		}
+		fmt.Fprintf(&list, "  %-*s  %s%s\n", nameWidth, tree.Name, abbreviateHome(tree.Path), files)
+	}
+
+	if m.fileCounts == nil {
+		list.WriteString("Counting the files...\n")
+	}
+
+	return list.String()
+}
+
+// mutatingKeys are the keys that change worktrees, branches or files,
+// which --read-only turns off.
+var mutatingKeys = map[string]bool{
+	"n": true, "N": true, "#": true, "m": true, "c": true, "R": true,
+	"F": true, "P": true, "L": true, "U": true, "d": true, "D": true,
+	"u": true, "p": true, "W": true, "X": true,
+}
+
+// keyDisabled tells whether --read-only turned the key off.
+func (m model) keyDisabled(key string) bool {
+	// While searching, n and N only jump between matches.
+	if (key == "n" || key == "N") && m.filter != "" {
+		return false
+	}
+
+	return m.readOnly && mutatingKeys[key]
 }
 
-type ByModifiedAt map[int]worktree
+// keyHelp lists every keybinding for the help screen.
+var keyHelp = []struct {
+	keys        string
+	description string
+}{
+	{"up, k", "Move the cursor up"},
+	{"down, j", "Move the cursor down"},
+	{"pgup, ctrl+u", "Move the cursor up a page"},
+	{"pgdown, ctrl+d", "Move the cursor down a page"},
+	{"home, g", "Jump to the first worktree"},
+	{"end, G", "Jump to the last worktree"},
+	{"enter, space", "Select or unselect the worktree"},
+	{"a", "Select all visible worktrees"},
+	{"A", "Clear the selection"},
+	{"n", "Create a new worktree (next match while filtering)"},
+	{"N", "Create a detached worktree (previous match while filtering)"},
+	{"#", "Create a worktree for a GitHub pull request"},
+	{"/", "Filter worktrees by name or branch, start with / for a regex"},
+	{"f", "Toggle between narrowing and highlighting matches"},
+	{"*", "Jump to the next worktree with uncommitted changes"},
+	{"v", "Cycle between all, only dirty and only clean worktrees"},
+	{"esc", "Clear the filters, the selection and any error"},
+	{"s", "Cycle the sort order"},
+	{"t", "Toggle relative and absolute modified times"},
+	{"z", "Show or hide the size column"},
+	{"tab, shift+tab", "Switch to the next or previous repo"},
+	{"o", "Quit and print the worktree path"},
+	{"i", "Show the status and changes of the worktree"},
+	{"e", "Open the worktree in your editor"},
+	{"O", "Open the worktree in the file manager"},
+	{"C", "Compare the two selected worktrees"},
+	{"y", "Copy the worktree path to the clipboard"},
+	{"Y", "Copy the worktree's branch name to the clipboard"},
+	{"m", "Move the worktree to another directory"},
+	{"c", "Check out another branch in the worktree"},
+	{"R", "Rename the worktree's branch"},
+	{"F", "Fetch in the worktree"},
+	{"P", "Pull the worktree's branch, fast-forward only"},
+	{"L", "Lock the worktree"},
+	{"U", "Unlock the worktree"},
+	{"d", "Delete the selected worktrees"},
+	{"D", "Force delete the selected worktrees"},
+	{"u", "Undo the last delete, without the uncommitted changes"},
+	{"p", "Prune stale worktree entries"},
+	{"W", "Repair the links to worktrees after moving the repo"},
+	{"X", "Clean untracked and ignored files out of the worktree"},
+	{"r", "Refresh the list"},
+	{"ctrl+r", "Refresh only the worktree under the cursor"},
+	{"?", "Toggle this help"},
+	{"q, ctrl+c", "Quit"},
+}
 
-func (a ByModifiedAt) Len() int           { return len(a) }
-func (a ByModifiedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByModifiedAt) Less(i, j int) bool { return a[i].modifiedAt < a[j].modifiedAt }
+func getHelp(m model) string {
+	var help strings.Builder
 
-func issueCommand(command string, args []string) ([]string, error) {
-	cmd := exec.Command(command, args...)
+	help.WriteString("\nKeybindings:\n\n")
+	for _, k := range keyHelp {
+		description := k.description
+		if m.keyDisabled(k.keys) {
+			description += " (off in read-only mode)"
+		}
+		help.WriteString(fmt.Sprintf("  %-14s %s\n", k.keys, description))
+	}
 
-	out, err := cmd.CombinedOutput()
-	lines := strings.Split(string(out), "\n")
+	if len(m.config.Keys) > 0 {
+		aliases := make([]string, 0, len(m.config.Keys))
+		for key := range m.config.Keys {
+			aliases = append(aliases, key)
+		}
+		sort.Strings(aliases)
 
-	if err != nil {
-		return lines, err
+		help.WriteString("\nCustom keys:\n\n")
+		for _, key := range aliases {
+			help.WriteString(fmt.Sprintf("  %-14s acts like %s\n", key, m.config.Keys[key]))
+		}
 	}
+	help.WriteString("\nPress ? or esc to go back\n")
 
-	return lines, nil
+	return help.String()
 }
 
-func parseLine(line string) worktree {
-	chunks := strings.Fields(line)
-	path := chunks[0]
-	path_parts := strings.Split(path, "/")
+func getFooter(m model) string {
+	if m.confirm != confirmNone {
+		return getConfirmation(m)
+	}
 
-	dateArgs := []string{"-I", "-r", path}
-	date, dateErr := issueCommand("date", dateArgs)
-	if dateErr != nil {
-		log.Fatal("date failed", dateErr)
+	switch m.prompt {
+	case promptFilter:
+		return fmt.Sprintf("\n/%s\n", m.input.View())
+	case promptBranch:
+		return fmt.Sprintf("\nNew worktree branch: %s\n%s", m.input.View(), getPicker(m))
+	case promptMove:
+		return fmt.Sprintf("\nMove %s to: %s\n", m.promptTree.Name, m.input.View())
+	case promptCheckout:
+		warning := ""
+		if m.promptTree.Dirty {
+			warning = " (has uncommitted changes, checkout may fail)"
+		}
+		return fmt.Sprintf("\nCheck out in %s%s (tab: complete): %s\n", m.promptTree.Name, warning, m.input.View())
+	case promptRename:
+		return fmt.Sprintf("\nRename branch %s to: %s\n", m.promptTree.Branch, m.input.View())
+	case promptDetach:
+		return fmt.Sprintf("\nNew detached worktree at: %s\n", m.input.View())
+	case promptPR:
+		return fmt.Sprintf("\nNew worktree for pull request #%s\n", m.input.View())
+	case promptBase:
+		return fmt.Sprintf("\nBase for %s (empty for HEAD, remote/branch to track): %s\n", m.newBranch, m.input.View())
 	}
 
-	return worktree{
-		name:       path_parts[len(path_parts)-1],
-		head:       chunks[1],
-		branch:     chunks[2][1 : len(chunks[2])-1],
-		modifiedAt: date[0],
+	var keys []string
+	for _, k := range footerKeys {
+		if m.keyDisabled(k.key) {
+			continue
+		}
+		if k.key == "n" && m.filter != "" {
+			keys = append(keys, "n/N: Next/Previous match")
+			continue
+		}
+		keys = append(keys, fmt.Sprintf("%s: %s", k.key, k.action))
 	}
+
+	return "\n" + strings.Join(keys, ", ") + "\n"
 }
 
-type model struct {
-	gitPath      string
-	bareRepoPath string
-	worktrees    map[int]worktree
-	cursor       int
-	selected     map[int]struct{}
-	errMsg       string
+// footerKeys are the keys the footer reminds of, ? shows the rest.
+var footerKeys = []struct {
+	key    string
+	action string
+}{
+	{"q", "Quit"},
+	{"Enter/Space", "Select"},
+	{"a/A", "All/None"},
+	{"n", "New"},
+	{"/", "Filter"},
+	{"s", "Sort"},
+	{"o", "Open"},
+	{"i", "Info"},
+	{"e", "Edit"},
+	{"m", "Move"},
+	{"c", "Checkout"},
+	{"d", "Delete"},
+	{"D", "Force Delete"},
+	{"p", "Prune"},
+	{"r", "Refresh"},
+	{"?", "Help"},
 }
 
-func initialModel(bareRepoPath string) model {
-	git, err := exec.LookPath("git")
-	if err != nil {
-		log.Fatal(err)
+// getPicker renders the branches matching the new branch prompt,
+// with a marker on the picked one.
+func getPicker(m model) string {
+	matches := m.branchMatches()
+	if len(matches) == 0 {
+		return ""
 	}
 
-	return model{
-		cursor:       0,
-		gitPath:      git,
-		bareRepoPath: bareRepoPath,
-		selected:     make(map[int]struct{}),
+	var picker strings.Builder
+	for i, branch := range matches[:min(len(matches), pickerSize)] {
+		marker := " "
+		if i == m.branchPick {
+			marker = ">"
+		}
+		picker.WriteString(fmt.Sprintf("  %s %s\n", marker, branch))
 	}
+	if more := len(matches) - pickerSize; more > 0 {
+		picker.WriteString(fmt.Sprintf("    ... %d more, keep typing\n", more))
+	}
+	picker.WriteString("  up/down: Pick an existing branch, tab: Complete, enter: Create\n")
+
+	return picker.String()
 }
 
-type deleteMsg int
-type errMsg struct {
-	err error
-	msg string
+func getDetails(m model) string {
+	tree, ok := m.current()
+	if !ok {
+		return ""
+	}
+
+	info := m.commits[tree.Path]
+	switch {
+	// Always take the same number of lines as a loaded commit,
+	// so the table doesn't resize while moving the cursor.
+	case !info.loaded:
+		return "\nLast commit: loading...\n\n"
+	case info.subject == "":
+		return "\nLast commit: none\n\n"
+	}
+
+	return fmt.Sprintf(
+		"\nLast commit: %s\n             %s, %s\n",
+		info.subject, info.author, info.date)
 }
-type listMsg map[int]worktree
 
-func (e errMsg) Error() string {
-	return e.err.Error()
+// getMessages renders the error and the status on their own lines,
+// always taking up two lines so the table doesn't jump around.
+func getMessages(m model) string {
+	var lines []string
+	if m.errMsg != "" {
+		lines = append(lines, fmt.Sprintf("\tERROR: %s", m.errMsg))
+	}
+	if m.status != "" {
+		lines = append(lines, fmt.Sprintf("\t%s", m.status))
+	}
+	for len(lines) < 2 {
+		lines = append(lines, "")
+	}
+
+	return strings.Join(lines, "\n") + "\n"
 }
 
-func deleteTrees(m model, force bool) tea.Cmd {
-	return func() tea.Msg {
-		for k := range m.selected {
-			tree := m.worktrees[k]
-			removeWorktree := []string{"-C", m.bareRepoPath, "worktree", "remove", tree.name}
+// getInfo renders the info pane.
+func getInfo(m model) string {
+	return fmt.Sprintf(
+		"\n%s\n\n%s\n\nup/down: Scroll, esc: Back\n",
+		m.infoTitle, m.info.View())
+}
 
-			if force {
-				removeWorktree = append(removeWorktree, "--force")
-			}
+func (m model) View() string {
+	if m.showHelp {
+		return getHelp(m)
+	}
+	if m.showInfo {
+		return getInfo(m)
+	}
 
-			removeOut, removeErr := issueCommand(m.gitPath, removeWorktree)
-			if removeErr != nil {
-				return errMsg{removeErr, removeOut[0]}
-			}
+	output := getHeader(m)
+	output += getMessages(m)
+	output += getTable(m)
+	output += getDetails(m)
+	output += getFooter(m)
 
-			removeBranch := []string{"-C", m.bareRepoPath, "branch", "-d", tree.branch}
-			removeBranchOut, removeBranchErr := issueCommand(m.gitPath, removeBranch)
-			if removeBranchErr != nil {
-				return errMsg{removeBranchErr, removeBranchOut[0]}
-			}
-		}
+	return output
+}
 
-		return deleteMsg(0)
+// These are set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// versionString puts the version together with whatever build details
+// were provided, like "tree-of-work 1.2.0 (a1b2c3d, 2024-01-18)".
+func versionString() string {
+	var details []string
+	if commit != "" {
+		details = append(details, commit)
+	}
+	if date != "" {
+		details = append(details, date)
+	}
+
+	if len(details) == 0 {
+		return "tree-of-work " + version
 	}
+
+	return fmt.Sprintf("tree-of-work %s (%s)", version, strings.Join(details, ", "))
 }
 
-func listTrees(git string, bareRepoPath string) tea.Cmd {
-	return func() tea.Msg {
-		worktreeList := []string{"-C", bareRepoPath, "worktree", "list"}
-		output, err := issueCommand(git, worktreeList)
+func usage() {
+	fmt.Println("Usage: tree-of-work [--no-color] [--dry-run] [--read-only] [--git path] [path-to-repo ...]")
+	fmt.Println("       tree-of-work --json [path-to-repo]")
+	fmt.Println("       tree-of-work --version")
+	fmt.Println("       tree-of-work list [--format tsv|pretty] [--columns name,branch,...] [path-to-repo]")
+	fmt.Println("       tree-of-work prune-branches --pattern glob [--merged] [--dry-run] [path-to-repo]")
+}
 
-		if err != nil {
-			return errMsg{err, output[0]}
-		}
+// findRepo returns the root of the repo the current directory is in.
+// That's the git dir of a bare repo and the main worktree otherwise,
+// even when starting from one of the other worktrees.
+func findRepo(git string) (string, bool) {
+	commonDir := []string{"rev-parse", "--path-format=absolute", "--git-common-dir"}
+	output, err := wt.ExecRunner{}.Run(git, commonDir)
+	if err != nil {
+		return "", false
+	}
+	gitDir := output[0]
 
-		worktrees := make(map[int]worktree, len(output)-2)
+	// Asked from one of its worktrees, even a bare repo says it isn't
+	// bare, so the question goes to the git dir itself.
+	isBare := []string{"-C", gitDir, "rev-parse", "--is-bare-repository"}
+	output, err = wt.ExecRunner{}.Run(git, isBare)
+	if err != nil {
+		return "", false
+	}
 
-		for i, line := range output {
-			if i == 0 || len(line) == 0 {
-				continue
-			}
-			worktrees[i-1] = parseLine(line)
-		}
+	if output[0] == "true" {
+		return gitDir, true
+	}
 
-		sort.Sort(ByModifiedAt(worktrees))
+	return filepath.Dir(gitDir), true
+}
+
+// checkRepo makes sure path points to a git repo, bare or not, so we
+// can fail early with a clear message instead of inside the TUI.
+func checkRepo(git string, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("%s does not exist", path)
+	}
 
-		return listMsg(worktrees)
+	revParse := []string{"-C", path, "rev-parse", "--git-dir"}
+	if _, err := (wt.ExecRunner{}).Run(git, revParse); err != nil {
+		return fmt.Errorf("%s is not a git repository", path)
 	}
+
+	return nil
 }
 
-func (m model) Init() tea.Cmd {
-	return listTrees(m.gitPath, m.bareRepoPath)
+// repoPathFromArgs picks the repo path from the arguments or, when
+// there are none, from TOW_REPO and then the repo we're currently in.
+func repoPathFromArgs(git string, args []string) (string, bool) {
+	if len(args) > 1 {
+		return "", false
+	}
+
+	paths, ok := repoPathsFromArgs(git, args)
+	if !ok {
+		return "", false
+	}
+
+	return paths[0], true
 }
 
-func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	switch msg := msg.(type) {
+// repoPathsFromArgs is like repoPathFromArgs, but takes any number
+// of repos for the TUI to switch between.
+func repoPathsFromArgs(git string, args []string) ([]string, bool) {
+	if len(args) > 0 {
+		return args, true
+	}
 
-	case errMsg:
-		m.errMsg = msg.msg
+	if path := os.Getenv("TOW_REPO"); path != "" {
+		return []string{path}, true
+	}
 
-	case listMsg:
-		m.worktrees = msg
+	path, ok := findRepo(git)
+	if !ok {
+		return nil, false
+	}
 
-	// After delete operations ran, we need to update
-	// the model accordingly otherwise the view will break.
-	case deleteMsg:
-		for k := range m.selected {
-			delete(m.selected, k)
-			delete(m.worktrees, k)
+	return []string{path}, true
+}
+
+// listColumns are the columns `tow list` knows how to print.
+var listColumns = []string{"name", "branch", "modified", "status", "head", "path"}
+
+func columnValue(tree worktree, column string, pretty bool) string {
+	switch column {
+	case "name":
+		return tree.Name
+	case "branch":
+		return branchLabel(tree)
+	case "modified":
+		if tree.ModifiedAt.IsZero() {
+			return "unknown"
+		}
+		if pretty {
+			return relativeTime(tree.ModifiedAt, time.Now())
 		}
-		if m.cursor >= len(m.worktrees) {
-			m.cursor = len(m.worktrees) - 1
+		return tree.ModifiedAt.Format(time.RFC3339)
+	case "status":
+		var flags []string
+		if tree.Prunable {
+			flags = append(flags, "missing")
 		}
+		if tree.Dirty {
+			flags = append(flags, "dirty")
+		}
+		if tree.Locked {
+			flags = append(flags, "locked")
+		}
+		return strings.Join(flags, ",")
+	case "head":
+		return tree.Head
+	case "path":
+		return tree.Path
+	}
 
-	case tea.KeyMsg:
-		switch msg.String() {
+	return ""
+}
 
-		case "r":
-			m.errMsg = ""
-			return m, listTrees(m.gitPath, m.bareRepoPath)
+// loadWorktrees lists the worktrees of the repo outside of the TUI,
+// sorted the same way the TUI starts out.
+func loadWorktrees(git string, bareRepoPath string) ([]worktree, error) {
+	if err := checkRepo(git, bareRepoPath); err != nil {
+		return nil, err
+	}
 
-		case "d":
-			m.errMsg = ""
-			return m, tea.Sequence(
-				deleteTrees(m, false),
-				listTrees(m.gitPath, m.bareRepoPath),
-			)
+	repo := wt.Repo{Git: git, Path: bareRepoPath}
+	worktrees, err := repo.List()
+	if err != nil {
+		return nil, err
+	}
 
-		case "D":
-			m.errMsg = ""
-			return m, tea.Sequence(
-				deleteTrees(m, true),
-				listTrees(m.gitPath, m.bareRepoPath),
-			)
+	sort.Sort(ByModifiedAt(worktrees))
 
-		case "ctrl+c", "q":
-			return m, tea.Quit
+	return worktrees, nil
+}
 
-		case "up", "k":
-			m.errMsg = ""
-			if m.cursor > 0 {
-				m.cursor--
-			}
+// runJSON prints the worktrees as a JSON array without starting the TUI.
+func runJSON(gitOverride string, args []string) int {
+	git, err := findGit(gitOverride)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
 
-		case "down", "j":
-			m.errMsg = ""
-			if m.cursor < len(m.worktrees)-1 {
-				m.cursor++
-			}
+	bareRepoPath, ok := repoPathFromArgs(git, args)
+	if !ok {
+		usage()
+		return 1
+	}
 
-		// The "enter" key and the spacebar (a literal space) toggle
-		// the selected state for the item that the cursor is pointing at.
-		case "enter", " ":
-			m.errMsg = ""
-			_, ok := m.selected[m.cursor]
-			if ok {
-				delete(m.selected, m.cursor)
-			} else {
-				m.selected[m.cursor] = struct{}{}
-			}
-		}
+	worktrees, err := loadWorktrees(git, bareRepoPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
 	}
 
-	return m, nil
+	if worktrees == nil {
+		worktrees = []worktree{}
+	}
+
+	output, err := json.MarshalIndent(worktrees, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	fmt.Println(string(output))
+	return 0
 }
 
-func getTerminalSize() (int, int) {
-	cmd := exec.Command("stty", "size")
-	cmd.Stdin = os.Stdin
-	out, sizeErr := cmd.Output()
+// runList prints the worktrees without starting the TUI.
+func runList(args []string) int {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	format := flags.String("format", "tsv", "output format: tsv or pretty")
+	gitOverride := flags.String("git", "", "the git binary to use")
+	columnList := flags.String("columns", "name,branch,modified", "comma separated columns: "+strings.Join(listColumns, ","))
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
 
-	rows := 40
-	columns := 80
+	if *format != "tsv" && *format != "pretty" {
+		fmt.Fprintf(os.Stderr, "error: unknown format %q\n", *format)
+		return 2
+	}
 
-	if sizeErr == nil {
-		fields := strings.Fields(string(out))
-		rows, _ = strconv.Atoi(fields[0])
-		columns, _ = strconv.Atoi(fields[1])
+	columns := strings.Split(*columnList, ",")
+	for _, column := range columns {
+		if !slices.Contains(listColumns, column) {
+			fmt.Fprintf(os.Stderr, "error: unknown column %q\n", column)
+			return 2
+		}
 	}
 
-	return rows, columns
-}
+	git, err := findGit(*gitOverride)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
 
-func getHeader(m model) string {
-	current := m.cursor + 1
-	if len(m.worktrees) == 0 {
-		current = 0
+	bareRepoPath, ok := repoPathFromArgs(git, flags.Args())
+	if !ok {
+		usage()
+		return 1
 	}
 
-	return fmt.Sprintf("\nYour worktrees: [%d/%d]\n\n", current, len(m.worktrees))
-}
+	worktrees, err := loadWorktrees(git, bareRepoPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
 
-func getLongestLen(m model) int {
-	result := 10 // length of a date string like 2000-10-10
-	for _, tree := range m.worktrees {
-		if len(tree.name) > result {
-			result = len(tree.name)
+	pretty := *format == "pretty"
+
+	var out io.Writer = os.Stdout
+	var table *tabwriter.Writer
+	if pretty {
+		table = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		out = table
+
+		header := make([]string, len(columns))
+		for i, column := range columns {
+			header[i] = strings.ToUpper(column)
 		}
+		fmt.Fprintln(out, strings.Join(header, "\t"))
+	}
 
-		if len(tree.branch) > result {
-			result = len(tree.branch)
+	for _, tree := range worktrees {
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = columnValue(tree, column, pretty)
 		}
+		fmt.Fprintln(out, strings.Join(values, "\t"))
 	}
 
-	return result
+	if table != nil {
+		table.Flush()
+	}
+
+	return 0
 }
 
-func getTable(m model) string {
-	var tabStrings strings.Builder
+// mergedBranches lists the local branches that are merged into the
+// branch HEAD of the repo points at.
+func mergedBranches(runner wt.Runner, git string, bareRepoPath string) (map[string]bool, error) {
+	head := []string{"-C", bareRepoPath, "symbolic-ref", "--short", "HEAD"}
+	lines, err := runner.Run(git, head)
+	if err != nil {
+		return nil, &wt.Error{Output: lines, Err: err}
+	}
+	into := strings.TrimSpace(lines[0])
 
-	rows, _ := getTerminalSize()
-	dataRows := rows - 5
-	start := 0
-	end := len(m.worktrees)
+	merged := []string{"-C", bareRepoPath, "branch", "--merged", into, "--format=%(refname:short)"}
+	lines, err = runner.Run(git, merged)
+	if err != nil {
+		return nil, &wt.Error{Output: lines, Err: err}
+	}
 
-	if end > 0 && dataRows < len(m.worktrees) {
-		end = dataRows
-		if m.cursor >= dataRows {
-			offset := (m.cursor + 1) - dataRows
-			if offset > 0 {
-				start = start + offset
-				end = start + dataRows
-			}
+	branches := make(map[string]bool)
+	for _, line := range lines {
+		// The branch everything is merged into is merged into itself.
+		if branch := strings.TrimSpace(line); branch != "" && branch != into {
+			branches[branch] = true
 		}
 	}
 
-	maxLen := getLongestLen(m)
-
-	// Render table headers
-	tabStrings.WriteString(fmt.Sprintf(
-		"%-5s %-*s  %-*s  %-*s\n",
-		"",
-		maxLen, "Worktree",
-		maxLen, "Branch",
-		maxLen, "Modified at"))
+	return branches, nil
+}
 
-	for i := start; i < end; i++ {
-		worktree := m.worktrees[i]
+// pruneCandidates picks the worktrees whose branch matches the glob
+// pattern and, unless merged is nil, is one of the merged branches.
+// The main worktree and detached ones are never picked.
+func pruneCandidates(worktrees []worktree, pattern string, merged map[string]bool) []worktree {
+	var picked []worktree
 
-		// Is the cursor pointing at this choice?
-		cursor := " " // no cursor
-		if m.cursor == i {
-			cursor = ">" // cursor!
+	for _, tree := range worktrees {
+		if tree.Main || tree.Detached {
+			continue
 		}
-
-		// Is this choice selected?
-		checked := " " // not selected
-		if _, ok := m.selected[i]; ok {
-			checked = "x" // selected!
+		if ok, _ := path.Match(pattern, tree.Branch); !ok {
+			continue
 		}
-
-		// Render the row
-		tabStrings.WriteString(
-			fmt.Sprintf(
-				"%s [%s] %-*s  %-*s  %-*s\n",
-				cursor, checked,
-				maxLen, worktree.name,
-				maxLen, worktree.branch,
-				maxLen, worktree.modifiedAt))
+		if merged != nil && !merged[tree.Branch] {
+			continue
+		}
+		picked = append(picked, tree)
 	}
 
-	return tabStrings.String()
+	return picked
 }
 
-func getFooter() string {
-	return "\nq: Quit, Enter/Space: Select, d: Delete, D: Force Delete, r: Refresh\n"
+// parseInterspersed parses flags that may come after the positional
+// arguments too, like `prune-branches ~/code/app.git --merged`, and
+// returns the positional ones.
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
 
-func getError(m model) string {
-	if m.errMsg != "" {
-		return fmt.Sprintf("\tERROR: %s\n\n", m.errMsg)
+// runPruneBranches removes the worktrees whose branch matches a
+// pattern, along with the branches, without starting the TUI.
+func runPruneBranches(args []string) int {
+	flags := flag.NewFlagSet("prune-branches", flag.ContinueOnError)
+	pattern := flags.String("pattern", "", "glob the branches have to match, like 'feature/*'")
+	onlyMerged := flags.Bool("merged", false, "only the branches merged into the default branch")
+	dryRun := flags.Bool("dry-run", false, "print the git commands instead of running them")
+	gitOverride := flags.String("git", "", "the git binary to use")
+	paths, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
 	}
 
-	return "\n\n"
-}
+	if *pattern == "" {
+		fmt.Fprintln(os.Stderr, "error: --pattern is required")
+		return 2
+	}
+	if _, err := path.Match(*pattern, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "error: bad pattern %q: %v\n", *pattern, err)
+		return 2
+	}
 
-func (m model) View() string {
+	git, err := findGit(*gitOverride)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
 
-	output := getHeader(m)
-	output += getError(m)
-	output += getTable(m)
-	output += getFooter()
+	bareRepoPath, ok := repoPathFromArgs(git, paths)
+	if !ok {
+		usage()
+		return 1
+	}
 
-	return output
-}
+	worktrees, err := loadWorktrees(git, bareRepoPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
 
-func usage() {
-	fmt.Println("Usage: tree-of-work <path-to-bare-repo>")
+	var merged map[string]bool
+	if *onlyMerged {
+		merged, err = mergedBranches(wt.ExecRunner{}, git, bareRepoPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+	}
+
+	repo := wt.Repo{Git: git, Path: bareRepoPath}
+	status := 0
+
+	// Neither removal is forced, so git keeps worktrees with
+	// uncommitted changes and branches that aren't merged anywhere.
+	for _, tree := range pruneCandidates(worktrees, *pattern, merged) {
+		if *dryRun {
+			fmt.Println(gitCommand(repo.RemoveArgs(tree, false)))
+			fmt.Println(gitCommand(repo.DeleteBranchArgs(tree.Branch, false)))
+			continue
+		}
+
+		if err := repo.Remove(tree, false); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %s\n", tree.Name, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("removed %s\n", tree.Path)
+
+		if err := repo.DeleteBranch(tree.Branch, false); err != nil {
+			fmt.Fprintf(os.Stderr, "error: branch %s: %s\n", tree.Branch, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("deleted branch %s\n", tree.Branch)
+	}
+
+	return status
 }
 
 func main() {
 
-	if len(os.Args) != 2 {
+	if len(os.Args) > 1 && os.Args[1] == "list" {
+		os.Exit(runList(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "prune-branches" {
+		os.Exit(runPruneBranches(os.Args[2:]))
+	}
+
+	jsonOutput := flag.Bool("json", false, "print the worktrees as JSON and exit")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	noColor := flag.Bool("no-color", false, "don't style the output")
+	dryRun := flag.Bool("dry-run", false, "show the git commands of changes instead of running them")
+	readOnly := flag.Bool("read-only", false, "turn off every key that changes worktrees or branches")
+	gitOverride := flag.String("git", "", "the git binary to use, instead of $TOW_GIT or git in the PATH")
+	flag.BoolVar(showVersion, "v", false, "print the version and exit")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	if *jsonOutput {
+		os.Exit(runJSON(*gitOverride, flag.Args()))
+	}
+
+	// See https://no-color.org.
+	if *noColor || os.Getenv("NO_COLOR") != "" {
+		disableStyles()
+	}
+
+	git, err := findGit(*gitOverride)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+
+	repoPaths, ok := repoPathsFromArgs(git, flag.Args())
+	if !ok {
 		usage()
 		os.Exit(1)
 	}
 
-	bareRepoPath := os.Args[1]
+	for _, repoPath := range repoPaths {
+		if err := checkRepo(git, repoPath); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
 
 	if len(os.Getenv("DEBUG")) > 0 {
 		f, err := tea.LogToFile("debug.log", "debug")
@@ -359,9 +4414,47 @@ func main() {
 		defer f.Close()
 	}
 
-	p := tea.NewProgram(initialModel(bareRepoPath))
-	if _, err := p.Run(); err != nil {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: bad config:", err)
+		os.Exit(1)
+	}
+
+	// The UI goes to stderr so stdout only carries the chosen path
+	// and can be captured with $(tow).
+	initial := initialModel(git, repoPaths, cfg)
+	initial.dryRun = *dryRun
+	initial.readOnly = *readOnly
+
+	initial = initial.withSavedSort()
+	startSort := initial.sortIndex
+
+	p := tea.NewProgram(
+		initial,
+		tea.WithOutput(os.Stderr),
+		tea.WithMouseCellMotion(),
+	)
+	final, err := p.Run()
+	if err != nil {
 		fmt.Printf("Coudn't run the program. Error: %v", err)
 		os.Exit(1)
 	}
+
+	m, ok := final.(model)
+	if !ok {
+		return
+	}
+
+	// Not being able to remember the sort order isn't worth
+	// bothering the user with.
+	_ = saveSort(startSort, m)
+
+	if m.chosenPath != "" {
+		fmt.Println(m.chosenPath)
+	}
+
+	// Scripts get to know that something didn't work out.
+	if len(m.failed) > 0 {
+		os.Exit(1)
+	}
 }
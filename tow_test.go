@@ -0,0 +1,1583 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+
+	wt "ziggytwister.com/tree-of-work/worktree"
+)
+
+// fakeRunner answers git calls from canned output keyed by the
+// joined arguments and records every call it gets.
+type fakeRunner struct {
+	outputs map[string][]string
+	fails   map[string]bool
+	calls   []string
+}
+
+func (f *fakeRunner) Run(command string, args []string) ([]string, error) {
+	call := strings.Join(args, " ")
+	f.calls = append(f.calls, call)
+
+	if f.fails[call] {
+		return []string{"fatal: " + call}, errors.New("exit status 128")
+	}
+
+	if output, ok := f.outputs[call]; ok {
+		return output, nil
+	}
+
+	return []string{""}, nil
+}
+
+// runCmd runs cmd along with every command it batches or sequences
+// and returns the messages they end up with.
+func runCmd(cmd tea.Cmd) []tea.Msg {
+	if cmd == nil {
+		return nil
+	}
+
+	msg := cmd()
+	cmds := reflect.ValueOf(msg)
+	if cmds.Kind() != reflect.Slice || cmds.Type().Elem() != reflect.TypeOf(cmd) {
+		return []tea.Msg{msg}
+	}
+
+	var msgs []tea.Msg
+	for i := 0; i < cmds.Len(); i++ {
+		msgs = append(msgs, runCmd(cmds.Index(i).Interface().(tea.Cmd))...)
+	}
+
+	return msgs
+}
+
+func newFakeModel(runner *fakeRunner) model {
+	return model{
+		runner:       runner,
+		gitPath:      "git",
+		bareRepoPath: "/repo",
+		repos:        []string{"/repo"},
+		repoStates:   make(map[string]repoState),
+		selected:     make(map[string]struct{}),
+		commits:      make(map[string]commitInfo),
+		sizes:        make(map[string]sizeInfo),
+		authors:      make(map[string]string),
+		input:        newInput(),
+		columns:      columnSet(nil),
+	}
+}
+
+func TestBranchLabelDetached(t *testing.T) {
+	tree := wt.Parse([]string{
+		"worktree /repo/review",
+		"HEAD 97cb16522daa830809f5621c3fe097e453da5125",
+		"detached",
+	})
+
+	if got, want := branchLabel(tree), "(detached at 97cb165)"; got != want {
+		t.Errorf("branchLabel = %q, want %q", got, want)
+	}
+}
+
+func TestListTrees(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string][]string{
+		"-C /repo worktree list --porcelain": {
+			"worktree /repo",
+			"bare",
+			"",
+			"worktree /repo/feature",
+			"HEAD 97cb16522daa830809f5621c3fe097e453da5125",
+			"branch refs/heads/feature",
+			"",
+			"worktree /repo/dirty",
+			"HEAD 97cb16522daa830809f5621c3fe097e453da5125",
+			"branch refs/heads/dirty",
+			"",
+		},
+		"-C /repo/dirty status --porcelain": {" M README.md", ""},
+	}}
+
+	msg := listTrees(newFakeModel(runner))()
+	list, ok := msg.(listMsg)
+	if !ok {
+		t.Fatalf("got %T, want listMsg", msg)
+	}
+	worktrees := list.worktrees
+
+	if len(worktrees) != 2 {
+		t.Fatalf("got %d worktrees, want 2 without the bare entry", len(worktrees))
+	}
+
+	for _, tree := range worktrees {
+		if want := tree.Name == "dirty"; tree.Dirty != want {
+			t.Errorf("%s: dirty = %v, want %v", tree.Name, tree.Dirty, want)
+		}
+	}
+}
+
+func TestListTreesError(t *testing.T) {
+	runner := &fakeRunner{fails: map[string]bool{
+		"-C /repo worktree list --porcelain": true,
+	}}
+
+	if _, ok := listTrees(newFakeModel(runner))().(errMsg); !ok {
+		t.Error("expected an errMsg when git fails")
+	}
+}
+
+func TestDeleteTrees(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.worktrees = []worktree{
+		{Path: "/repo/feature", Name: "feature", Branch: "feature"},
+		{Path: "/repo/review", Name: "review", Branch: "(detached)", Detached: true},
+		{Path: "/repo/usb", Name: "usb", Branch: "usb", Locked: true},
+		{Path: "/repo/other", Name: "other", Branch: "other"},
+	}
+	m.selected["/repo/feature"] = struct{}{}
+	m.selected["/repo/review"] = struct{}{}
+	m.selected["/repo/usb"] = struct{}{}
+
+	tests := []struct {
+		name           string
+		force          bool
+		deleteBranches bool
+		want           []string
+	}{
+		{
+			name: "keep branches",
+			want: []string{
+				"-C /repo worktree remove /repo/feature",
+				"-C /repo worktree remove /repo/review",
+				"-C /repo worktree remove /repo/usb",
+			},
+		},
+		{
+			name:           "delete branches",
+			deleteBranches: true,
+			want: []string{
+				"-C /repo worktree remove /repo/feature",
+				"-C /repo branch -d feature",
+				"-C /repo worktree remove /repo/review",
+				"-C /repo worktree remove /repo/usb",
+				"-C /repo branch -d usb",
+			},
+		},
+		{
+			name:  "force",
+			force: true,
+			want: []string{
+				"-C /repo worktree remove /repo/feature --force",
+				"-C /repo worktree remove /repo/review --force",
+				"-C /repo worktree remove /repo/usb --force --force",
+			},
+		},
+		{
+			name:           "force with branches",
+			force:          true,
+			deleteBranches: true,
+			want: []string{
+				"-C /repo worktree remove /repo/feature --force",
+				"-C /repo branch -D feature",
+				"-C /repo worktree remove /repo/review --force",
+				"-C /repo worktree remove /repo/usb --force --force",
+				"-C /repo branch -D usb",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			m.runner = runner
+			m.deleteBranches = test.deleteBranches
+
+			if _, ok := deleteTrees(m, test.force)().(deleteMsg); !ok {
+				t.Fatal("expected a deleteMsg")
+			}
+
+			if !reflect.DeepEqual(runner.calls, test.want) {
+				t.Errorf("calls = %q, want %q", runner.calls, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("missing config: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, config{}) {
+		t.Errorf("missing config gave %+v, want defaults", cfg)
+	}
+
+	path, err := configPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"sort": "name desc", "deleteBranches": true, "keys": {"x": "D"}}`)
+	cfg, err = loadConfig()
+	if err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+	if cfg.Sort != "name desc" || !cfg.DeleteBranches || cfg.Keys["x"] != "D" {
+		t.Errorf("got %+v", cfg)
+	}
+
+	write(`{"sort": "size asc"}`)
+	if _, err := loadConfig(); err == nil {
+		t.Error("expected an error for an unknown sort order")
+	}
+
+	write(`{"pathTemplate": "../worktrees"}`)
+	if _, err := loadConfig(); err == nil {
+		t.Error("expected an error for a path template without {branch}")
+	}
+
+	write(`{"columns": ["branch", "owner"]}`)
+	if _, err := loadConfig(); err == nil {
+		t.Error("expected an error for an unknown column")
+	}
+
+	write(`{"gitTimeout": "soon"}`)
+	if _, err := loadConfig(); err == nil {
+		t.Error("expected an error for a timeout that isn't a duration")
+	}
+
+	write(`{not json`)
+	if _, err := loadConfig(); err == nil {
+		t.Error("expected an error for malformed JSON")
+	}
+}
+
+func TestDeleteTreesDryRun(t *testing.T) {
+	runner := &fakeRunner{}
+	m := newFakeModel(runner)
+	m.dryRun = true
+	m.deleteBranches = true
+	m.worktrees = []worktree{{Path: "/repo/my feature", Name: "my feature", Branch: "feature"}}
+	m.selected["/repo/my feature"] = struct{}{}
+
+	msg := deleteTrees(m, false)()
+
+	if len(runner.calls) != 0 {
+		t.Errorf("ran %q, want nothing", runner.calls)
+	}
+
+	want := statusMsg("Dry run: git -C /repo worktree remove '/repo/my feature'; git -C /repo branch -d feature")
+	if msg != want {
+		t.Errorf("got %q, want %q", msg, want)
+	}
+}
+
+func TestDeleteTreesArchivesFirst(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "archive")
+	runner := &fakeRunner{}
+	m := newFakeModel(runner)
+	m.config.ArchiveDir = dir
+	m.archive = true
+	m.worktrees = []worktree{{Path: "/repo/review", Name: "review", Branch: "(detached)", Detached: true}}
+	m.selected["/repo/review"] = struct{}{}
+
+	result, ok := deleteTrees(m, false)().(deleteMsg)
+	if !ok {
+		t.Fatal("expected a deleteMsg")
+	}
+
+	if len(result.archived) != 1 || filepath.Dir(result.archived[0]) != dir {
+		t.Errorf("archived %q, want one bundle in %s", result.archived, dir)
+	}
+
+	want := []string{
+		"-C /repo/review bundle create " + result.archived[0] + " HEAD",
+		"-C /repo worktree remove /repo/review",
+	}
+	if !slices.Equal(runner.calls, want) {
+		t.Errorf("calls = %q, want %q", runner.calls, want)
+	}
+
+	// Without an archive the worktree has to stay.
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m.config.ArchiveDir = filepath.Join(blocker, "archive")
+
+	result = deleteTrees(m, false)().(deleteMsg)
+	if len(result.deleted) != 0 || len(result.failures) != 1 {
+		t.Errorf("deleted %q, failed %q, want nothing deleted", result.deleted, result.failures)
+	}
+}
+
+func TestDeleteConfirmationCountsFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "sub/b.go"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("package a"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := newFakeModel(&fakeRunner{})
+	m.worktrees = []worktree{{Path: dir, Name: "feature", Branch: "feature"}}
+	m.selected[dir] = struct{}{}
+	m.confirm = confirmDelete
+
+	if footer := getFooter(m); !strings.Contains(footer, "Counting the files") {
+		t.Errorf("footer before counting:\n%s", footer)
+	}
+
+	next, _ := m.Update(loadFileCounts(m)())
+	footer := getFooter(next.(model))
+	if !strings.Contains(footer, "feature  "+dir+" (2 files)") || strings.Contains(footer, "Counting the files") {
+		t.Errorf("footer after counting:\n%s", footer)
+	}
+}
+
+func TestDeleteConfirmationListsPaths(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	for i := 0; i < maxConfirmList+2; i++ {
+		path := fmt.Sprintf("/repo/tree-%d", i)
+		m.worktrees = append(m.worktrees, worktree{Path: path, Name: filepath.Base(path)})
+		m.selected[path] = struct{}{}
+	}
+	m.confirm = confirmForceDelete
+
+	footer := getFooter(m)
+	for _, want := range []string{"tree-0  /repo/tree-0", "tree-7  /repo/tree-7", "...and 2 more", "Force delete 10 worktrees?"} {
+		if !strings.Contains(footer, want) {
+			t.Errorf("footer is missing %q:\n%s", want, footer)
+		}
+	}
+	if strings.Contains(footer, "/repo/tree-8") {
+		t.Errorf("footer lists more than %d worktrees:\n%s", maxConfirmList, footer)
+	}
+}
+
+func TestConfirmDeleteFrom(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		selected []string
+		confirm  confirm
+	}{
+		{"one clean", "d", []string{"/repo/a"}, confirmNone},
+		{"one dirty", "d", []string{"/repo/dirty"}, confirmDelete},
+		{"two", "d", []string{"/repo/a", "/repo/b"}, confirmDelete},
+		{"one locked", "D", []string{"/repo/locked"}, confirmForceDelete},
+		{"one with unpushed commits", "D", []string{"/repo/ahead"}, confirmForceDelete},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newFakeModel(&fakeRunner{outputs: map[string][]string{
+				"-C /repo remote": {"origin", ""},
+				"-C /repo/ahead rev-list --count HEAD --not --remotes": {"3", ""},
+			}})
+			m.config.ConfirmDeleteFrom = 2
+			m.worktrees = []worktree{
+				{Path: "/repo/a", Name: "a"},
+				{Path: "/repo/b", Name: "b"},
+				{Path: "/repo/dirty", Name: "dirty", Dirty: true},
+				{Path: "/repo/locked", Name: "locked", Locked: true},
+				{Path: "/repo/ahead", Name: "ahead"},
+			}
+			m = m.applyFilter()
+			for _, path := range test.selected {
+				m.selected[path] = struct{}{}
+			}
+
+			next, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(test.key)})
+			m = next.(model)
+
+			// Small deletes count the unpushed commits before going ahead.
+			if m.pendingDelete != confirmNone {
+				next, _ = m.Update(loadUnpushed(m)())
+				m = next.(model)
+			}
+
+			if m.confirm != test.confirm {
+				t.Errorf("confirm = %v, want %v", m.confirm, test.confirm)
+			}
+			if deleting := m.isLoading; deleting != (test.confirm == confirmNone) {
+				t.Errorf("deleting right away = %v, want %v", deleting, test.confirm == confirmNone)
+			}
+		})
+	}
+}
+
+func TestUndoDelete(t *testing.T) {
+	head := "97cb16522daa830809f5621c3fe097e453da5125"
+	runner := &fakeRunner{}
+	m := newFakeModel(runner)
+	m.deleteBranches = true
+	m.worktrees = []worktree{
+		{Path: "/repo/feature", Name: "feature", Branch: "feature", Head: head},
+		{Path: "/repo/review", Name: "review", Branch: "(detached)", Head: head, Detached: true},
+	}
+	m.selected["/repo/feature"] = struct{}{}
+	m.selected["/repo/review"] = struct{}{}
+
+	next, _ := m.Update(deleteTrees(m, false)())
+	m = next.(model)
+	if len(m.lastDelete.trees) != 2 {
+		t.Fatalf("remembered %d worktrees, want 2", len(m.lastDelete.trees))
+	}
+
+	runner.calls = nil
+	if _, ok := restoreTrees(m, m.lastDelete)().(restoreMsg); !ok {
+		t.Fatal("expected a restoreMsg")
+	}
+
+	want := []string{
+		"-C /repo branch feature " + head,
+		"-C /repo worktree add /repo/feature feature",
+		"-C /repo worktree add --detach /repo/review " + head,
+	}
+	if !slices.Equal(runner.calls, want) {
+		t.Errorf("calls = %q, want %q", runner.calls, want)
+	}
+
+	// There's only one undo.
+	next, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("u")})
+	next, _ = next.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("u")})
+	if got := next.(model).errMsg; got != "nothing to undo" {
+		t.Errorf("second undo gave %q, want nothing to undo", got)
+	}
+}
+
+func TestDeleteTreesContinuesAfterFailure(t *testing.T) {
+	runner := &fakeRunner{fails: map[string]bool{"-C /repo worktree remove /repo/review": true}}
+	m := newFakeModel(runner)
+	m.worktrees = []worktree{
+		{Path: "/repo/feature", Name: "feature", Branch: "feature"},
+		{Path: "/repo/review", Name: "review", Branch: "review"},
+		{Path: "/repo/usb", Name: "usb", Branch: "usb"},
+	}
+	for _, tree := range m.worktrees {
+		m.selected[tree.Path] = struct{}{}
+	}
+	m = m.applyFilter()
+
+	msg, ok := deleteTrees(m, false)().(deleteMsg)
+	if !ok {
+		t.Fatal("expected a deleteMsg")
+	}
+
+	if want := []string{"/repo/feature", "/repo/usb"}; !reflect.DeepEqual(msg.deleted, want) {
+		t.Errorf("deleted = %q, want %q", msg.deleted, want)
+	}
+
+	next, _ := m.Update(msg)
+	m = next.(model)
+
+	if len(m.worktrees) != 1 || m.worktrees[0].Name != "review" {
+		t.Errorf("worktrees = %v, want only review", m.worktrees)
+	}
+	if !m.isSelected(m.worktrees[0]) {
+		t.Error("expected the failed worktree to stay selected")
+	}
+	if !strings.HasPrefix(m.errMsg, "Deleted 2, failed 1 (review: fatal:") {
+		t.Errorf("errMsg = %q", m.errMsg)
+	}
+}
+
+func TestState(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+
+	if st := loadState(); st != (state{}) {
+		t.Errorf("missing state gave %+v, want defaults", st)
+	}
+
+	if err := saveState(state{Sort: "branch desc"}); err != nil {
+		t.Fatal(err)
+	}
+	if st := loadState(); st.Sort != "branch desc" {
+		t.Errorf("got %+v, want the saved sort order", st)
+	}
+
+	path, err := statePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, corrupt := range []string{`{not json`, `{"sort": "size asc"}`} {
+		if err := os.WriteFile(path, []byte(corrupt), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if st := loadState(); st != (state{}) {
+			t.Errorf("%s gave %+v, want defaults", corrupt, st)
+		}
+	}
+}
+
+func TestConfigSortWithoutPickingOne(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+
+	// A run that never pressed s leaves nothing behind.
+	m := newFakeModel(&fakeRunner{})
+	m.sortIndex = sortIndex("name desc")
+	if err := saveSort(m.sortIndex, m); err != nil {
+		t.Fatal(err)
+	}
+
+	m.sortIndex = sortIndex("branch asc")
+	if got := m.withSavedSort().sortIndex; got != sortIndex("branch asc") {
+		t.Errorf("sort = %s, want the configured branch asc", sortOrders[got])
+	}
+
+	// Picking one with s is remembered over the config.
+	start := m.sortIndex
+	next, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("s")})
+	picked := next.(model).sortIndex
+	if err := saveSort(start, next.(model)); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.withSavedSort().sortIndex; got != picked {
+		t.Errorf("sort = %s, want the picked %s", sortOrders[got], sortOrders[picked])
+	}
+}
+
+func TestDeleteLastWorktree(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.worktrees = []worktree{{Path: "/repo/feature", Name: "feature", Branch: "feature"}}
+	m.loaded = true
+	m.selected["/repo/feature"] = struct{}{}
+	m = m.applyFilter()
+
+	next, _ := m.Update(deleteMsg{deleted: []string{"/repo/feature"}})
+	m = next.(model)
+
+	if m.cursor != 0 {
+		t.Errorf("cursor = %d, want 0", m.cursor)
+	}
+
+	if !strings.Contains(m.View(), "No worktrees found") {
+		t.Error("expected the empty state in the view")
+	}
+}
+
+func TestLoadingBeforeFirstList(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+
+	if view := m.View(); !strings.Contains(view, "Loading worktrees...") || strings.Contains(view, "No worktrees found") {
+		t.Errorf("view before the first list:\n%s", view)
+	}
+
+	next, _ := m.Update(listMsg{"/repo", nil})
+	if view := next.View(); !strings.Contains(view, "No worktrees found") {
+		t.Errorf("view after an empty list:\n%s", view)
+	}
+}
+
+func TestStatusFilter(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.worktrees = []worktree{
+		{Path: "/repo/clean", Name: "clean"},
+		{Path: "/repo/dirty", Name: "dirty", Dirty: true},
+	}
+	m = m.applyFilter()
+
+	visible := func(m model) []string {
+		var names []string
+		for _, k := range m.visible {
+			names = append(names, m.worktrees[k].Name)
+		}
+		return names
+	}
+
+	for _, want := range [][]string{{"dirty"}, {"clean"}, {"clean", "dirty"}} {
+		next, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("v")})
+		m = next.(model)
+		if got := visible(m); !slices.Equal(got, want) {
+			t.Errorf("showing %s: visible = %q, want %q", m.statusFilter, got, want)
+		}
+	}
+}
+
+func TestHeaderCountsFilteredTotal(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.worktrees = []worktree{
+		{Path: "/repo/api", Name: "api"},
+		{Path: "/repo/web", Name: "web"},
+		{Path: "/repo/web-old", Name: "web-old"},
+	}
+	m = m.applyFilter()
+
+	if header := getHeader(m); !strings.Contains(header, "[1/3]") {
+		t.Errorf("unfiltered header = %q, want [1/3]", header)
+	}
+
+	m.filter = "web"
+	m = m.applyFilter()
+	if header := getHeader(m); !strings.Contains(header, "[1/2 (of 3)]") {
+		t.Errorf("filtered header = %q, want [1/2 (of 3)]", header)
+	}
+}
+
+func TestCleanTree(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string][]string{
+		"-C /repo/feature clean -xfd --dry-run": {"Would remove build/", "Would remove node_modules/", ""},
+		"-C /repo/feature clean -xfd":           {"Removing build/", "Removing node_modules/", ""},
+	}}
+	m := newFakeModel(runner)
+	m.worktrees = []worktree{{Path: "/repo/feature", Name: "feature", Branch: "feature"}}
+	m = m.applyFilter()
+
+	next, _ := m.Update(cleanTree(m, m.worktrees[0], true)())
+	m = next.(model)
+	if m.confirm != confirmClean {
+		t.Fatalf("confirm = %v after the dry run, want confirmClean", m.confirm)
+	}
+	if footer := getFooter(m); !strings.Contains(footer, "node_modules/") || !strings.Contains(footer, "Clean 2 paths out of feature?") {
+		t.Errorf("footer = %q, want the paths to clean", footer)
+	}
+	if got := runner.calls; !slices.Equal(got, []string{"-C /repo/feature clean -xfd --dry-run"}) {
+		t.Errorf("calls before confirming = %q, want only the dry run", got)
+	}
+
+	next, _ = m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("y")})
+	cleanTree(next.(model), m.cleanTarget, false)()
+	if got := runner.calls[len(runner.calls)-1]; got != "-C /repo/feature clean -xfd" {
+		t.Errorf("last call = %q, want the real clean", got)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	runner := &fakeRunner{}
+	m := newFakeModel(runner)
+	m.readOnly = true
+	m.config.Keys = map[string]string{"x": "D"}
+	m.worktrees = []worktree{
+		{Path: "/repo/api", Name: "api"},
+		{Path: "/repo/web", Name: "web"},
+	}
+	m = m.applyFilter()
+	m.selected["/repo/api"] = struct{}{}
+
+	for _, key := range []string{"d", "x", "p", "n"} {
+		next, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key)})
+		got := next.(model)
+		if got.confirm != confirmNone || got.prompt != promptNone {
+			t.Errorf("%s started an action in read-only mode", key)
+		}
+		if !strings.Contains(got.errMsg, "read-only") {
+			t.Errorf("%s: errMsg = %q, want a read-only note", key, got.errMsg)
+		}
+	}
+	if len(runner.calls) > 0 {
+		t.Errorf("calls = %q, want none", runner.calls)
+	}
+
+	next, _ := m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	if next.(model).cursor != 1 {
+		t.Error("navigation should still work in read-only mode")
+	}
+	if footer := getFooter(m); strings.Contains(footer, "Delete") || !strings.Contains(footer, "Filter") {
+		t.Errorf("footer = %q, want only the keys that work", footer)
+	}
+	if help := getHelp(m); !strings.Contains(help, "Create a new worktree (next match while filtering) (off in read-only mode)") {
+		t.Errorf("help doesn't show n as off:\n%s", help)
+	}
+
+	// While filtering, n and N jump between matches and keep working.
+	m.filter = "web"
+	m = m.applyFilter()
+	if footer := getFooter(m); !strings.Contains(footer, "n/N: Next/Previous match") {
+		t.Errorf("footer = %q, want n while filtering", footer)
+	}
+	if help := getHelp(m); strings.Contains(help, "(next match while filtering) (off") {
+		t.Errorf("help shows n as off while filtering:\n%s", help)
+	}
+}
+
+func TestRepairTrees(t *testing.T) {
+	repair := "-C /repo worktree repair"
+	runner := &fakeRunner{outputs: map[string][]string{
+		repair: {"repair: gitdir incorrect: /code/feature/.git", ""},
+	}}
+	m := newFakeModel(runner)
+
+	msg := repairTrees(m)()
+	if got := string(msg.(statusMsg)); got != "Repaired: repair: gitdir incorrect: /code/feature/.git" {
+		t.Errorf("status = %q", got)
+	}
+
+	runner.outputs[repair] = []string{""}
+	if got := string(repairTrees(m)().(statusMsg)); got != "Nothing to repair" {
+		t.Errorf("status = %q, want Nothing to repair", got)
+	}
+}
+
+func TestJumpToDirty(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.sortIndex = sortIndex("name asc")
+	m.worktrees = []worktree{
+		{Path: "/repo/a", Name: "a", Dirty: true},
+		{Path: "/repo/b", Name: "b"},
+		{Path: "/repo/c", Name: "c", Dirty: true},
+	}
+	m = m.applyFilter()
+
+	for _, want := range []int{2, 0, 2} {
+		next, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("*")})
+		m = next.(model)
+		if m.cursor != want {
+			t.Fatalf("cursor = %d, want %d", m.cursor, want)
+		}
+	}
+
+	m.worktrees[0].Dirty = false
+	m.worktrees[2].Dirty = false
+	if _, found := m.jumpToDirty(); found {
+		t.Error("found a dirty worktree in a clean list")
+	}
+}
+
+func TestColumns(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.columns = columnSet([]string{"status"})
+	m.worktrees = []worktree{{Path: "/repo/feature", Name: "feature", Branch: "feature-branch", Dirty: true}}
+	m = m.applyFilter()
+
+	table := getTable(m)
+	for _, want := range []string{"Worktree", "Status", "* dirty"} {
+		if !strings.Contains(table, want) {
+			t.Errorf("table is missing %q:\n%s", want, table)
+		}
+	}
+	for _, hidden := range []string{"Branch", "feature-branch", "Modified at", "Size"} {
+		if strings.Contains(table, hidden) {
+			t.Errorf("table shows the hidden %q:\n%s", hidden, table)
+		}
+	}
+}
+
+func TestHeadColumn(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.columns = columnSet([]string{"branch", "head"})
+	m.worktrees = []worktree{{Path: "/repo/feature", Name: "feature", Branch: "feature", Head: "4f2a9c81d3e5b7a60c2f1e9d8b7a6c5d4e3f2a1b"}}
+	m = m.applyFilter()
+
+	table := getTable(m)
+	for _, want := range []string{"Head", "4f2a9c8"} {
+		if !strings.Contains(table, want) {
+			t.Errorf("table is missing %q:\n%s", want, table)
+		}
+	}
+	if strings.Contains(table, "4f2a9c81") {
+		t.Errorf("table shows more than the short SHA:\n%s", table)
+	}
+}
+
+func TestAuthorColumn(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string][]string{
+		"-C /repo/feature log -1 --format=%an 4f2a9c8": {"Ada Lovelace", ""},
+	}}
+	m := newFakeModel(runner)
+	m.columns = columnSet([]string{"author"})
+	m.worktrees = []worktree{{Path: "/repo/feature", Name: "feature", Branch: "feature", Head: "4f2a9c8"}}
+	m = m.applyFilter()
+
+	if table := getTable(m); !strings.Contains(table, "...") {
+		t.Errorf("table before loading the author:\n%s", table)
+	}
+
+	for _, load := range loadAuthors(m)().(tea.BatchMsg) {
+		next, _ := m.Update(load())
+		m = next.(model)
+	}
+	if table := getTable(m); !strings.Contains(table, "Ada Lovelace") {
+		t.Errorf("table is missing the author:\n%s", table)
+	}
+
+	// Authors are kept by commit, so they aren't asked for again.
+	if cmd := loadAuthors(m); cmd != nil {
+		t.Error("loadAuthors asked again for a known commit")
+	}
+	if len(runner.calls) != 1 {
+		t.Errorf("calls = %q, want one log call", runner.calls)
+	}
+}
+
+func TestCopyBranchOfDetached(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.worktrees = []worktree{{Path: "/repo/review", Name: "review", Branch: "(detached)", Detached: true}}
+	m = m.applyFilter()
+
+	next, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("Y")})
+	if got := next.(model).errMsg; !strings.Contains(got, "no branch to copy") {
+		t.Errorf("errMsg = %q, want a note about the missing branch", got)
+	}
+}
+
+func TestAddTreeTracksRemoteBranch(t *testing.T) {
+	remotes := map[string][]string{"-C /repo remote": {"origin", ""}}
+	missingLocal := "-C /repo rev-parse --verify --quiet refs/heads/feature-x"
+	missingRemote := "-C /repo rev-parse --verify --quiet refs/remotes/origin/feature-x"
+
+	tests := []struct {
+		name   string
+		branch string
+		base   string
+		fails  map[string]bool
+		want   string
+	}{
+		{
+			name:   "remote base",
+			branch: "feature-x",
+			base:   "origin/feature-x",
+			fails:  map[string]bool{missingLocal: true},
+			want:   "-C /repo worktree add --track -b feature-x feature-x origin/feature-x",
+		},
+		{
+			name:   "remote branch as the name",
+			branch: "origin/feature-x",
+			fails:  map[string]bool{missingLocal: true},
+			want:   "-C /repo worktree add --track -b feature-x feature-x origin/feature-x",
+		},
+		{
+			name:   "local branch collides",
+			branch: "feature-x",
+			base:   "origin/feature-x",
+		},
+		{
+			name:   "remote branch is missing",
+			branch: "feature-x",
+			base:   "origin/feature-x",
+			fails:  map[string]bool{missingLocal: true, missingRemote: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeRunner{outputs: remotes, fails: test.fails}
+			msg := addTree(newFakeModel(runner), test.branch, test.base)()
+
+			if test.want == "" {
+				if _, ok := msg.(errMsg); !ok {
+					t.Fatalf("got %T, want errMsg", msg)
+				}
+				return
+			}
+
+			if _, ok := msg.(addMsg); !ok {
+				t.Fatalf("got %v, want addMsg", msg)
+			}
+
+			if last := runner.calls[len(runner.calls)-1]; last != test.want {
+				t.Errorf("ran %q, want %q", last, test.want)
+			}
+		})
+	}
+}
+
+func TestJumpToMatchWraps(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	for _, name := range []string{"api-a", "web", "api-b", "docs"} {
+		m.worktrees = append(m.worktrees, worktree{Path: "/repo/" + name, Name: name, Branch: name})
+	}
+	m.sortIndex = sortIndex("name asc")
+	m.highlightOnly = true
+	m.filter = "api"
+	m = m.applyFilter()
+
+	// Sorted by name: api-a, api-b, docs, web.
+	if !reflect.DeepEqual(m.matches, []int{0, 1}) {
+		t.Fatalf("matches = %v, want [0 1]", m.matches)
+	}
+
+	m.cursor = 1
+	if m = m.jumpToMatch(true); m.cursor != 0 {
+		t.Errorf("n from the last match: cursor = %d, want 0", m.cursor)
+	}
+
+	if m = m.jumpToMatch(false); m.cursor != 1 {
+		t.Errorf("N from the first match: cursor = %d, want 1", m.cursor)
+	}
+}
+
+func TestRegexFilter(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.sortIndex = sortIndex("name asc")
+	m.worktrees = []worktree{
+		{Path: "/repo/fix-123", Name: "fix-123", Branch: "fix/123"},
+		{Path: "/repo/feature", Name: "feature", Branch: "feature"},
+		{Path: "/repo/fix-abc", Name: "fix-abc", Branch: "fix/abc"},
+	}
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"fix", []string{"fix-123", "fix-abc"}},
+		{`/^FIX-\d+$`, []string{"fix-123"}},
+		{"/^f.*e$", []string{"feature"}},
+		// Doesn't compile, so it's looked for as it is.
+		{"/fix-[", nil},
+	}
+
+	for _, test := range tests {
+		m.filter = test.filter
+		m = m.applyFilter()
+
+		var got []string
+		for _, k := range m.visible {
+			got = append(got, m.worktrees[k].Name)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("filter %q shows %q, want %q", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestAbbreviateHome(t *testing.T) {
+	t.Setenv("HOME", "/home/gizmo")
+
+	tests := map[string]string{
+		"/home/gizmo":            "~",
+		"/home/gizmo/code/x.git": "~/code/x.git",
+		"/home/gizmonaut/x.git":  "/home/gizmonaut/x.git",
+		"/srv/x.git":             "/srv/x.git",
+	}
+	for path, want := range tests {
+		if got := abbreviateHome(path); got != want {
+			t.Errorf("abbreviateHome(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestMouseClick(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.height = 40
+	m.worktrees = []worktree{
+		{Path: "/repo/api", Name: "api", Branch: "api"},
+		{Path: "/repo/web", Name: "web", Branch: "web"},
+	}
+	m = m.applyFilter()
+
+	lines := strings.Split(m.View(), "\n")
+	y := firstRowLine(m) + 1
+	if !strings.Contains(lines[y], "web") {
+		t.Fatalf("line %d is %q, want the web row", y, lines[y])
+	}
+
+	next, _ := m.Update(tea.MouseMsg{Type: tea.MouseLeft, X: 20, Y: y})
+	m = next.(model)
+	if m.cursor != 1 || len(m.selected) != 0 {
+		t.Errorf("clicking the row: cursor = %d, selected = %d, want 1 and 0", m.cursor, len(m.selected))
+	}
+
+	next, _ = m.Update(tea.MouseMsg{Type: tea.MouseLeft, X: 3, Y: y - 1})
+	m = next.(model)
+	if m.cursor != 0 || !m.isSelected(m.worktrees[0]) {
+		t.Errorf("clicking the checkbox: cursor = %d, want 0 and api selected", m.cursor)
+	}
+}
+
+func TestViewFitsTheScreen(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.width = 80
+	m.height = 20
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("tree-%02d", i)
+		m.worktrees = append(m.worktrees, worktree{Path: "/repo/" + name, Name: name, Branch: name})
+	}
+	m = m.applyFilter()
+
+	for _, cursor := range []int{0, 25, 49} {
+		m.cursor = cursor
+		if lines := strings.Count(m.View(), "\n") + 1; lines != m.height {
+			t.Errorf("cursor %d: view takes %d lines, want %d", cursor, lines, m.height)
+		}
+	}
+}
+
+func TestTableFitsNarrowTerminals(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.width = 60
+	m.worktrees = []worktree{{
+		Path:   "/repo/a-worktree-with-a-really-long-name",
+		Name:   "a-worktree-with-a-really-long-name",
+		Branch: "feature/a-branch-with-an-even-longer-name",
+		Dirty:  true,
+	}}
+	m = m.applyFilter()
+
+	for _, line := range strings.Split(getTable(m), "\n") {
+		if width := lipgloss.Width(line); width > m.width {
+			t.Errorf("line is %d wide, want at most %d: %q", width, m.width, line)
+		}
+	}
+
+	if table := getTable(m); !strings.Contains(table, "a-worktree…") || !strings.Contains(table, "* dirty") {
+		t.Errorf("expected a shortened name and the whole status:\n%s", table)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in    string
+		width int
+		want  string
+	}{
+		{"feature", 10, "feature"},
+		{"feature", 7, "feature"},
+		{"feature", 5, "feat…"},
+		{"ünïcödé", 4, "ünï…"},
+		{"feature", 1, "…"},
+	}
+
+	for _, test := range tests {
+		if got := truncate(test.in, test.width); got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.in, test.width, got, test.want)
+		}
+	}
+}
+
+func TestSwitchRepo(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.repos = []string{"/repo", "/other"}
+	m.worktrees = []worktree{{Path: "/repo/api", Name: "api", Branch: "api"}}
+	m.selected["/repo/api"] = struct{}{}
+	m = m.applyFilter()
+
+	m, _ = m.switchRepo(1)
+	if m.bareRepoPath != "/other" || len(m.worktrees) != 0 || len(m.selected) != 0 {
+		t.Fatalf("after switching: repo %s, %d worktrees, %d selected", m.bareRepoPath, len(m.worktrees), len(m.selected))
+	}
+
+	// A list of the repo we just left mustn't show up here.
+	next, _ := m.Update(listMsg{"/repo", []worktree{{Path: "/repo/web", Name: "web"}}})
+	m = next.(model)
+	if len(m.worktrees) != 0 {
+		t.Errorf("got the worktrees of the other repo")
+	}
+
+	m, _ = m.switchRepo(-1)
+	if m.bareRepoPath != "/repo" || len(m.worktrees) != 1 || !m.isSelected(m.worktrees[0]) {
+		t.Errorf("switching back didn't bring back the worktrees and the selection")
+	}
+}
+
+func TestMainWorktreeCantBeDeleted(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.worktrees = []worktree{
+		{Path: "/src/app", Name: "app", Branch: "main", Main: true},
+		{Path: "/src/feature", Name: "feature", Branch: "feature"},
+	}
+	m.selected["/src/app"] = struct{}{}
+	m.selected["/src/feature"] = struct{}{}
+	m = m.applyFilter()
+
+	m = m.startDelete(confirmDelete)
+	if m.confirm != confirmNone || !strings.Contains(m.errMsg, "main worktree") {
+		t.Errorf("confirm = %v, errMsg = %q, want no confirmation and an error", m.confirm, m.errMsg)
+	}
+
+	delete(m.selected, "/src/app")
+	if m = m.startDelete(confirmDelete); m.confirm != confirmDelete {
+		t.Errorf("confirm = %v, want confirmDelete", m.confirm)
+	}
+}
+
+func TestIsCurrent(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.cwd = "/repo/feature/src"
+
+	for path, want := range map[string]bool{
+		"/repo/feature":   true,
+		"/repo/feature-2": false,
+		"/repo/other":     false,
+	} {
+		if got := m.isCurrent(worktree{Path: path}); got != want {
+			t.Errorf("isCurrent(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	tests := map[int64]string{
+		0:                "0B",
+		1023:             "1023B",
+		1536:             "1.5K",
+		5 * 1024 * 1024:  "5.0M",
+		3 << 40:          "3.0T",
+		2048 * (1 << 40): "2048.0T",
+	}
+	for bytes, want := range tests {
+		if got := humanSize(bytes); got != want {
+			t.Errorf("humanSize(%d) = %q, want %q", bytes, got, want)
+		}
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a"), make([]byte, 100), 0o644)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0o755)
+	os.WriteFile(filepath.Join(dir, "sub", "b"), make([]byte, 50), 0o644)
+
+	if got := dirSize(dir); got != 150 {
+		t.Errorf("dirSize() = %d, want 150", got)
+	}
+}
+
+func TestIsStale(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	old := worktree{ModifiedAt: now.AddDate(0, 0, -40)}
+	recent := worktree{ModifiedAt: now.AddDate(0, 0, -10)}
+
+	m := newFakeModel(&fakeRunner{})
+	if !m.isStale(old, now) || m.isStale(recent, now) || m.isStale(worktree{}, now) {
+		t.Error("the default threshold should only catch the old worktree")
+	}
+
+	m.config.StaleAfterDays = 7
+	if !m.isStale(recent, now) {
+		t.Error("a 7 day threshold should catch the recent worktree")
+	}
+
+	m.config.StaleAfterDays = -1
+	if m.isStale(old, now) {
+		t.Error("a negative threshold should turn it off")
+	}
+}
+
+func TestAddTreeNextToMainWorktree(t *testing.T) {
+	runner := &fakeRunner{fails: map[string]bool{"-C /src/app rev-parse --verify --quiet refs/heads/feature": true}}
+	m := newFakeModel(runner)
+	m.bareRepoPath = "/src/app"
+	m.worktrees = []worktree{{Path: "/src/app", Name: "app", Branch: "main", Main: true}}
+
+	if _, ok := addTree(m, "feature", "")().(addMsg); !ok {
+		t.Fatal("expected an addMsg")
+	}
+
+	want := "-C /src/app worktree add -b feature /src/feature"
+	if last := runner.calls[len(runner.calls)-1]; last != want {
+		t.Errorf("ran %q, want %q", last, want)
+	}
+}
+
+func TestNewTreePathTemplate(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.bareRepoPath = "/src/app.git"
+
+	m.config.PathTemplate = "../worktrees/{branch}"
+	if got, want := newTreePath(m, "feature/foo"), "/src/worktrees/feature-foo"; got != want {
+		t.Errorf("relative template gave %q, want %q", got, want)
+	}
+
+	m.config.PathTemplate = "/tmp/{branch}-wt"
+	if got, want := newTreePath(m, "fix"), "/tmp/fix-wt"; got != want {
+		t.Errorf("absolute template gave %q, want %q", got, want)
+	}
+}
+
+func TestAddTreeAsksForMissingDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "worktrees")
+	runner := &fakeRunner{fails: map[string]bool{"-C /repo rev-parse --verify --quiet refs/heads/feature": true}}
+	m := newFakeModel(runner)
+	m.config.PathTemplate = dir + "/{branch}"
+
+	msg, ok := addTree(m, "feature", "")().(mkdirMsg)
+	if !ok || msg.dir != dir {
+		t.Fatalf("got %+v, want to be asked about %s", msg, dir)
+	}
+
+	next, _ := m.Update(msg)
+	m = next.(model)
+	if m.confirm != confirmMkdir {
+		t.Fatal("expected a confirmation")
+	}
+
+	if _, ok := createDir(m.missingDir, m.pendingAdd)().(addMsg); !ok {
+		t.Fatal("expected the add to go ahead once the directory is there")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("directory wasn't created: %v", err)
+	}
+
+	want := "-C /repo worktree add -b feature " + filepath.Join(dir, "feature")
+	if last := runner.calls[len(runner.calls)-1]; last != want {
+		t.Errorf("ran %q, want %q", last, want)
+	}
+}
+
+func TestAddDetachedTree(t *testing.T) {
+	runner := &fakeRunner{}
+	m := newFakeModel(runner)
+
+	if _, ok := addDetachedTree(m, "origin/release")().(addMsg); !ok {
+		t.Fatal("expected an addMsg")
+	}
+
+	want := []string{"-C /repo worktree add --detach origin-release origin/release"}
+	if !slices.Equal(runner.calls, want) {
+		t.Errorf("calls = %q, want %q", runner.calls, want)
+	}
+}
+
+func TestAddPullRequestTree(t *testing.T) {
+	fetch := "-C /repo fetch upstream pull/42/head:pr-42"
+	runner := &fakeRunner{outputs: map[string][]string{"-C /repo remote": {"upstream", ""}}}
+	m := newFakeModel(runner)
+
+	if _, ok := addPullRequestTree(m, 42)().(addMsg); !ok {
+		t.Fatal("expected an addMsg")
+	}
+
+	want := []string{"-C /repo remote", fetch, "-C /repo worktree add pr-42 pr-42"}
+	if !slices.Equal(runner.calls, want) {
+		t.Errorf("calls = %q, want %q", runner.calls, want)
+	}
+
+	runner.fails = map[string]bool{fetch: true}
+	msg, ok := addPullRequestTree(m, 42)().(errMsg)
+	if !ok || !strings.Contains(msg.msg, "fetching pull request #42 from upstream failed") {
+		t.Errorf("failed fetch = %#v, want an errMsg about the fetch", msg)
+	}
+}
+
+func TestSortTiesGoByName(t *testing.T) {
+	day := time.Date(2024, 1, 18, 0, 0, 0, 0, time.UTC)
+	worktrees := []worktree{
+		{Path: "/repo/c", Name: "c", Branch: "x", ModifiedAt: day},
+		{Path: "/repo/a", Name: "a", Branch: "x", ModifiedAt: day},
+		{Path: "/repo/b", Name: "b", Branch: "x", ModifiedAt: day.Add(-time.Hour)},
+	}
+
+	tests := map[string][]string{
+		"modified asc":  {"b", "a", "c"},
+		"modified desc": {"a", "c", "b"},
+		"branch desc":   {"a", "b", "c"},
+	}
+	for order, want := range tests {
+		sorted := slices.Clone(worktrees)
+		o := sortOrders[sortIndex(order)]
+		sort.Slice(sorted, func(i, j int) bool { return o.less(sorted[i], sorted[j]) })
+
+		var got []string
+		for _, tree := range sorted {
+			got = append(got, tree.Name)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", order, got, want)
+		}
+	}
+}
+
+func TestSortByLastCommit(t *testing.T) {
+	now := time.Now()
+	m := newFakeModel(&fakeRunner{})
+	m.sortIndex = sortIndex("commit desc")
+	// Built just now, but nobody has committed there for a month.
+	m.worktrees = []worktree{
+		{Path: "/repo/old", Name: "old", ModifiedAt: now, LastCommitAt: now.AddDate(0, -1, 0)},
+		{Path: "/repo/new", Name: "new", ModifiedAt: now.AddDate(0, 0, -1), LastCommitAt: now.Add(-time.Hour)},
+	}
+	m = m.applyFilter()
+
+	if first := m.worktrees[m.visible[0]].Name; first != "new" {
+		t.Errorf("first = %s, want the latest commit first", first)
+	}
+}
+
+func TestBranchPicker(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string][]string{
+		"-C /repo for-each-ref --format=%(refname) refs/heads refs/remotes": {
+			"refs/heads/main",
+			"refs/heads/feature-x",
+			"refs/remotes/origin/HEAD",
+			"refs/remotes/origin/feature-y",
+			"",
+		},
+	}}
+	m := newFakeModel(runner)
+	m = m.applyFilter()
+
+	next, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("n")})
+	m = next.(model)
+	next, _ = m.Update(loadBranches(m)())
+	m = next.(model)
+
+	if want := []string{"main", "feature-x", "origin/feature-y"}; !reflect.DeepEqual(m.branches, want) {
+		t.Fatalf("branches = %q, want %q", m.branches, want)
+	}
+
+	for _, key := range []tea.KeyMsg{
+		{Type: tea.KeyRunes, Runes: []rune("feat")},
+		{Type: tea.KeyDown},
+		{Type: tea.KeyDown},
+	} {
+		next, _ = m.Update(key)
+		m = next.(model)
+	}
+
+	if got := m.branchMatches()[m.branchPick]; got != "origin/feature-y" {
+		t.Fatalf("picked %q, want origin/feature-y", got)
+	}
+
+	next, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m = next.(model)
+	if m.prompt != promptNone || cmd == nil {
+		t.Error("expected enter to close the prompt and add the worktree")
+	}
+}
+
+func TestUnpushedWarning(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string][]string{
+		"-C /repo remote": {"origin", ""},
+		"-C /repo/feature rev-list --count HEAD --not --remotes": {"3", ""},
+		"-C /repo/pushed rev-list --count HEAD --not --remotes":  {"0", ""},
+	}}
+	m := newFakeModel(runner)
+	m.worktrees = []worktree{
+		{Path: "/repo/feature", Name: "feature", Branch: "feature"},
+		{Path: "/repo/pushed", Name: "pushed", Branch: "pushed"},
+	}
+	m.selected["/repo/feature"] = struct{}{}
+	m.selected["/repo/pushed"] = struct{}{}
+	m = m.applyFilter()
+
+	next, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("d")})
+	m = next.(model)
+	if m.confirm != confirmDelete || cmd == nil {
+		t.Fatal("expected the delete confirmation and the unpushed check")
+	}
+
+	next, _ = m.Update(loadUnpushed(m)())
+	m = next.(model)
+
+	view := m.View()
+	if !strings.Contains(view, "branch feature has 3 unpushed commits") {
+		t.Errorf("missing the warning for feature in:\n%s", view)
+	}
+	if strings.Contains(view, "branch pushed") {
+		t.Errorf("unexpected warning for pushed in:\n%s", view)
+	}
+}
+
+func TestRefreshTree(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string][]string{
+		"-C /repo/feature rev-parse HEAD":                    {"abc123", ""},
+		"-C /repo/feature symbolic-ref --short --quiet HEAD": {"feature-2", ""},
+		"-C /repo/feature log -1 --format=%ct":               {"1700000000", ""},
+		"-C /repo/feature status --porcelain":                {" M tow.go", ""},
+	}}
+	m := newFakeModel(runner)
+	m.worktrees = []worktree{
+		{Path: "/repo/feature", Name: "feature", Branch: "feature"},
+		{Path: "/repo/other", Name: "other", Branch: "other"},
+	}
+	m = m.applyFilter()
+
+	next, _ := m.Update(refreshTree(m, m.worktrees[0])())
+	m = next.(model)
+
+	got := m.worktrees[slices.IndexFunc(m.worktrees, func(w worktree) bool { return w.Name == "feature" })]
+	if got.Head != "abc123" || got.Branch != "feature-2" || !got.Dirty || got.LastCommitAt.Unix() != 1700000000 {
+		t.Errorf("got %+v, want the new head, branch, commit time and dirty state", got)
+	}
+	if len(runner.calls) != 4 {
+		t.Errorf("ran %q, want only the calls for the one worktree", runner.calls)
+	}
+}
+
+func TestCompleteBranch(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	m.prompt = promptCheckout
+	m.branches = []string{"main", "feature/login", "feature/logout", "origin/feature/x"}
+	m.input.SetValue("feat")
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		next, _ := m.Update(tea.KeyMsg{Type: tea.KeyTab})
+		m = next.(model)
+		got = append(got, m.input.Value())
+	}
+
+	want := []string{"feature/login", "feature/logout", "feature/login"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tab gave %q, want %q", got, want)
+	}
+}
+
+func TestErrorTimesOut(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+
+	next, _ := m.Update(errMsg{errors.New("exit status 1"), "fatal: first"})
+	next, _ = next.Update(errMsg{errors.New("exit status 1"), "fatal: second"})
+
+	// The first error's timeout must not cut the second one short.
+	next, _ = next.Update(clearErrorMsg(1))
+	if got := next.(model).errMsg; got != "fatal: second" {
+		t.Fatalf("errMsg = %q after an old timeout, want the second error", got)
+	}
+
+	next, _ = next.Update(clearErrorMsg(2))
+	if got := next.(model).errMsg; got != "" {
+		t.Errorf("errMsg = %q after its timeout, want it cleared", got)
+	}
+}
+
+func TestPruneCandidates(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string][]string{
+		"-C /repo symbolic-ref --short HEAD":                      {"main", ""},
+		"-C /repo branch --merged main --format=%(refname:short)": {"feature/done", "main", "other", ""},
+	}}
+
+	merged, err := mergedBranches(runner, "git", "/repo")
+	if err != nil {
+		t.Fatalf("mergedBranches: %v", err)
+	}
+
+	worktrees := []worktree{
+		{Name: "app", Branch: "main", Main: true},
+		{Name: "done", Branch: "feature/done"},
+		{Name: "wip", Branch: "feature/wip"},
+		{Name: "deep", Branch: "feature/x/y"},
+		{Name: "other", Branch: "other"},
+		{Name: "review", Branch: "(detached)", Detached: true},
+	}
+
+	tests := []struct {
+		name    string
+		pattern string
+		merged  map[string]bool
+		want    []string
+	}{
+		{"merged only", "feature/*", merged, []string{"done"}},
+		{"any", "feature/*", nil, []string{"done", "wip"}},
+		{"main is kept", "*", nil, []string{"other"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, tree := range pruneCandidates(worktrees, tt.pattern, tt.merged) {
+				got = append(got, tree.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("pruneCandidates = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInterspersed(t *testing.T) {
+	flags := flag.NewFlagSet("prune-branches", flag.ContinueOnError)
+	merged := flags.Bool("merged", false, "")
+
+	paths, err := parseInterspersed(flags, []string{"/code/app.git", "--merged"})
+	if err != nil {
+		t.Fatalf("parseInterspersed: %v", err)
+	}
+	if !*merged || !slices.Equal(paths, []string{"/code/app.git"}) {
+		t.Errorf("merged = %v, paths = %v", *merged, paths)
+	}
+}
+
+func TestRepoPathFromTowRepo(t *testing.T) {
+	t.Setenv("TOW_REPO", "/code/app.git")
+
+	if path, ok := repoPathFromArgs("git", nil); !ok || path != "/code/app.git" {
+		t.Errorf("repoPathFromArgs() = %q, %v, want TOW_REPO", path, ok)
+	}
+	if path, ok := repoPathFromArgs("git", []string{"/code/web.git"}); !ok || path != "/code/web.git" {
+		t.Errorf("repoPathFromArgs(/code/web.git) = %q, %v, want the argument", path, ok)
+	}
+}
+
+func TestLockWithAliasedKey(t *testing.T) {
+	runner := &fakeRunner{}
+	m := newFakeModel(runner)
+	m.config.Keys = map[string]string{"l": "L"}
+	m.worktrees = []worktree{{Path: "/repo/feature", Name: "feature", Branch: "feature"}}
+	m = m.applyFilter()
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("l")})
+	runCmd(cmd)
+
+	if !slices.Contains(runner.calls, "-C /repo worktree lock /repo/feature") {
+		t.Errorf("calls = %q, want the worktree locked", runner.calls)
+	}
+}
+
+func TestOnlyMutatingFailuresCount(t *testing.T) {
+	m := newFakeModel(&fakeRunner{})
+	update := func(msg tea.Msg) {
+		t.Helper()
+		next, _ := m.Update(msg)
+		m = next.(model)
+	}
+
+	update(errMsg{errors.New("exit status 1"), "clipboard not available"})
+	if len(m.failed) > 0 {
+		t.Errorf("failed = %v after a read-only error, want none", m.failed)
+	}
+
+	update(actionMsg{"lock /repo/a", errMsg{errors.New("exit status 128"), "fatal: locked"}})
+	update(deleteMsg{failures: []string{"b: fatal: dirty"}, failedPaths: []string{"/repo/b"}})
+	if !m.failed["lock /repo/a"] || !m.failed["delete /repo/b"] {
+		t.Errorf("failed = %v, want the lock and the delete", m.failed)
+	}
+
+	update(actionMsg{"lock /repo/a", lockMsg(0)})
+	update(deleteMsg{deleted: []string{"/repo/b"}})
+	if len(m.failed) > 0 {
+		t.Errorf("failed = %v after the retries worked, want none", m.failed)
+	}
+}
+
+func TestRefreshStatus(t *testing.T) {
+	list := "-C /repo worktree list --porcelain"
+	runner := &fakeRunner{outputs: map[string][]string{
+		list: {"worktree /repo/feature", "HEAD 4f2a9c8", "branch refs/heads/feature", ""},
+	}}
+	m := newFakeModel(runner)
+
+	next, _ := m.Update(refreshTrees(m)())
+	if got := next.(model).status; got != "List refreshed" {
+		t.Errorf("status = %q, want List refreshed", got)
+	}
+
+	runner.fails = map[string]bool{list: true}
+	next, _ = m.Update(refreshTrees(m)())
+	if got := next.(model); got.status != "" || got.errMsg == "" {
+		t.Errorf("status = %q, errMsg = %q after a failed list, want only the error", got.status, got.errMsg)
+	}
+}
@@ -0,0 +1,315 @@
+// Package worktree lists and removes the worktrees of a git repo by
+// talking to the git command line.
+package worktree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Worktree is a single working tree as git reports it, plus what tow
+// finds out about it on disk.
+type Worktree struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Head       string    `json:"head"`
+	Branch     string    `json:"branch"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	// LastCommitAt is when HEAD was committed, which says more about
+	// the last real work than file times touched by builds.
+	LastCommitAt time.Time `json:"lastCommitAt"`
+	Detached     bool      `json:"detached"`
+	Dirty        bool      `json:"dirty"`
+	Locked       bool      `json:"locked"`
+	// Prunable worktrees have lost their directory, git can prune them.
+	Prunable bool `json:"prunable"`
+	// Bare is the entry git lists for a bare repo itself, List skips it.
+	Bare bool `json:"-"`
+	// Main is the repo's own working tree, the first one git lists.
+	// Bare repos don't have one.
+	Main bool `json:"-"`
+}
+
+// Runner runs external commands and returns their output lines.
+// Tests swap in a fake one.
+type Runner interface {
+	Run(command string, args []string) ([]string, error)
+}
+
+// ErrTimeout is returned by ExecRunner for a command that took longer
+// than its timeout and got killed.
+var ErrTimeout = errors.New("timed out")
+
+// waitDelay is how long a killed command's children get to close its
+// output before Run stops waiting for them.
+const waitDelay = 2 * time.Second
+
+// ExecRunner runs commands for real.
+type ExecRunner struct {
+	// Timeout kills commands that take longer, so one waiting for a
+	// password nobody types doesn't hang forever. Zero means no limit.
+	Timeout time.Duration
+}
+
+func (r ExecRunner) Run(command string, args []string) ([]string, error) {
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	// Killing git leaves its ssh or credential helper children holding
+	// the output open, so the wait for them gets cut short too.
+	cmd.WaitDelay = waitDelay
+
+	out, err := cmd.CombinedOutput()
+	lines := strings.Split(string(out), "\n")
+
+	// Whatever the command printed before it was killed doesn't
+	// explain what went wrong.
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		message := fmt.Sprintf("%s timed out after %s", filepath.Base(command), r.Timeout)
+		return []string{message}, fmt.Errorf("%s: %w", message, ErrTimeout)
+	}
+
+	if err != nil {
+		return lines, err
+	}
+
+	return lines, nil
+}
+
+// Error is a git command that failed. Its message is the line git
+// used to explain why.
+type Error struct {
+	Output []string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	// A Runner may fail without any output to explain why.
+	if line := ErrorLine(e.Output); line != "" || e.Err == nil {
+		return line
+	}
+
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorLine picks the line git used to explain a failure. Some commands
+// print progress before the actual error, so the first line isn't enough.
+func ErrorLine(lines []string) string {
+	for _, line := range lines {
+		if strings.HasPrefix(line, "fatal:") || strings.HasPrefix(line, "error:") {
+			return line
+		}
+	}
+
+	if len(lines) == 0 {
+		return ""
+	}
+
+	return lines[0]
+}
+
+// SplitRecords groups the output of `git worktree list --porcelain`
+// into records. Each record describes one worktree and records are
+// separated by an empty line.
+func SplitRecords(lines []string) [][]string {
+	var records [][]string
+	var record []string
+
+	for _, line := range lines {
+		if len(line) == 0 {
+			if len(record) > 0 {
+				records = append(records, record)
+				record = nil
+			}
+			continue
+		}
+		record = append(record, line)
+	}
+
+	if len(record) > 0 {
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// Parse reads a single porcelain record. Every line is an attribute
+// name optionally followed by a space and its value.
+// Unknown attributes are ignored.
+func Parse(record []string) Worktree {
+	var tree Worktree
+
+	for _, line := range record {
+		label, value, _ := strings.Cut(line, " ")
+
+		switch label {
+		case "worktree":
+			tree.Path = value
+			tree.Name = filepath.Base(value)
+		case "HEAD":
+			tree.Head = value
+		case "branch":
+			tree.Branch = strings.TrimPrefix(value, "refs/heads/")
+		case "detached":
+			tree.Detached = true
+			tree.Branch = "(detached)"
+		case "bare":
+			tree.Bare = true
+		case "locked":
+			tree.Locked = true
+		case "prunable":
+			tree.Prunable = true
+		}
+	}
+
+	return tree
+}
+
+// Repo is a git repo, bare or not, whose worktrees are managed.
+type Repo struct {
+	// Git is the git executable to run.
+	Git string
+	// Path is the bare repo, or the main worktree of a normal one.
+	Path string
+	// Runner runs git, ExecRunner when it's nil.
+	Runner Runner
+}
+
+func (r Repo) run(args []string) ([]string, error) {
+	runner := r.Runner
+	if runner == nil {
+		runner = ExecRunner{}
+	}
+
+	out, err := runner.Run(r.Git, args)
+	if err != nil {
+		return out, &Error{out, err}
+	}
+
+	return out, nil
+}
+
+// List returns the worktrees in the order git lists them, main
+// worktree first. The entry of a bare repo itself is left out.
+func (r Repo) List() ([]Worktree, error) {
+	output, err := r.run([]string{"-C", r.Path, "worktree", "list", "--porcelain"})
+	if err != nil {
+		return nil, err
+	}
+
+	var worktrees []Worktree
+
+	for i, record := range SplitRecords(output) {
+		tree := Parse(record)
+		if tree.Bare {
+			continue
+		}
+		tree.Main = i == 0
+		worktrees = append(worktrees, r.Inspect(tree))
+	}
+
+	return worktrees, nil
+}
+
+// Inspect fills in what the porcelain output doesn't tell: when the
+// worktree was last modified, when its HEAD was committed and whether
+// it's dirty.
+func (r Repo) Inspect(tree Worktree) Worktree {
+	// A worktree we can't stat keeps a zero ModifiedAt and
+	// shows up as unknown instead of taking the whole program down.
+	if info, statErr := os.Stat(tree.Path); statErr == nil {
+		tree.ModifiedAt = info.ModTime()
+	}
+
+	// There's nothing left on disk to ask git about.
+	if tree.Prunable {
+		return tree
+	}
+
+	tree.LastCommitAt = r.LastCommitAt(tree.Path)
+	tree.Dirty = r.IsDirty(tree.Path)
+
+	return tree
+}
+
+// LastCommitAt tells when the HEAD of the worktree at path was
+// committed. A worktree without commits gives the zero time.
+func (r Repo) LastCommitAt(path string) time.Time {
+	out, err := r.run([]string{"-C", path, "log", "-1", "--format=%ct"})
+	if err != nil || len(out) == 0 {
+		return time.Time{}
+	}
+
+	seconds, err := strconv.ParseInt(strings.TrimSpace(out[0]), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(seconds, 0)
+}
+
+// IsDirty tells whether the worktree at path has uncommitted changes.
+func (r Repo) IsDirty(path string) bool {
+	status, err := r.run([]string{"-C", path, "status", "--porcelain"})
+	if err != nil {
+		return false
+	}
+
+	return len(strings.TrimSpace(strings.Join(status, "\n"))) > 0
+}
+
+// RemoveArgs are the git arguments Remove runs.
+func (r Repo) RemoveArgs(tree Worktree, force bool) []string {
+	args := []string{"-C", r.Path, "worktree", "remove", tree.Path}
+
+	if force {
+		args = append(args, "--force")
+		// Git wants the flag twice to remove a locked worktree.
+		if tree.Locked {
+			args = append(args, "--force")
+		}
+	}
+
+	return args
+}
+
+// Remove deletes the worktree from disk and from git's records.
+// Forcing also removes dirty and locked worktrees.
+func (r Repo) Remove(tree Worktree, force bool) error {
+	_, err := r.run(r.RemoveArgs(tree, force))
+	return err
+}
+
+// DeleteBranchArgs are the git arguments DeleteBranch runs.
+func (r Repo) DeleteBranchArgs(branch string, force bool) []string {
+	// Forcing also drops branches with unmerged commits.
+	deleteFlag := "-d"
+	if force {
+		deleteFlag = "-D"
+	}
+
+	return []string{"-C", r.Path, "branch", deleteFlag, branch}
+}
+
+// DeleteBranch deletes a local branch, which is usually what's left
+// after removing its worktree.
+func (r Repo) DeleteBranch(branch string, force bool) error {
+	_, err := r.run(r.DeleteBranchArgs(branch, force))
+	return err
+}
@@ -0,0 +1,359 @@
+package worktree
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRunner answers git calls from canned output keyed by the
+// joined arguments and records every call it gets.
+type fakeRunner struct {
+	outputs map[string][]string
+	fails   map[string]bool
+	calls   []string
+}
+
+func (f *fakeRunner) Run(command string, args []string) ([]string, error) {
+	call := strings.Join(args, " ")
+	f.calls = append(f.calls, call)
+
+	if f.fails[call] {
+		return []string{"fatal: " + call}, errors.New("exit status 128")
+	}
+
+	if output, ok := f.outputs[call]; ok {
+		return output, nil
+	}
+
+	return []string{""}, nil
+}
+
+func TestParse(t *testing.T) {
+	head := "97cb16522daa830809f5621c3fe097e453da5125"
+
+	tests := []struct {
+		name   string
+		record []string
+		want   Worktree
+	}{
+		{
+			name: "branch",
+			record: []string{
+				"worktree /repo/feature",
+				"HEAD " + head,
+				"branch refs/heads/feature",
+			},
+			want: Worktree{
+				Path:   "/repo/feature",
+				Name:   "feature",
+				Head:   head,
+				Branch: "feature",
+			},
+		},
+		{
+			name: "branch with slashes",
+			record: []string{
+				"worktree /repo/fix",
+				"HEAD " + head,
+				"branch refs/heads/fix/login",
+			},
+			want: Worktree{
+				Path:   "/repo/fix",
+				Name:   "fix",
+				Head:   head,
+				Branch: "fix/login",
+			},
+		},
+		{
+			name: "detached",
+			record: []string{
+				"worktree /repo/review",
+				"HEAD " + head,
+				"detached",
+			},
+			want: Worktree{
+				Path:     "/repo/review",
+				Name:     "review",
+				Head:     head,
+				Branch:   "(detached)",
+				Detached: true,
+			},
+		},
+		{
+			name: "bare",
+			record: []string{
+				"worktree /repo",
+				"bare",
+			},
+			want: Worktree{
+				Path: "/repo",
+				Name: "repo",
+				Bare: true,
+			},
+		},
+		{
+			name: "path with spaces",
+			record: []string{
+				"worktree /repo/my feature",
+				"HEAD " + head,
+				"branch refs/heads/my-feature",
+			},
+			want: Worktree{
+				Path:   "/repo/my feature",
+				Name:   "my feature",
+				Head:   head,
+				Branch: "my-feature",
+			},
+		},
+		{
+			name: "locked with a reason",
+			record: []string{
+				"worktree /repo/usb",
+				"HEAD " + head,
+				"branch refs/heads/usb",
+				"locked on a usb stick",
+			},
+			want: Worktree{
+				Path:   "/repo/usb",
+				Name:   "usb",
+				Head:   head,
+				Branch: "usb",
+				Locked: true,
+			},
+		},
+		{
+			name: "prunable",
+			record: []string{
+				"worktree /repo/gone",
+				"HEAD " + head,
+				"branch refs/heads/gone",
+				"prunable gitdir file points to non-existent location",
+			},
+			want: Worktree{
+				Path:     "/repo/gone",
+				Name:     "gone",
+				Head:     head,
+				Branch:   "gone",
+				Prunable: true,
+			},
+		},
+		{
+			name:   "empty",
+			record: []string{},
+			want:   Worktree{},
+		},
+		{
+			name:   "malformed",
+			record: []string{"this is not porcelain"},
+			want:   Worktree{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := Parse(test.record)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestErrorLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"fatal after progress", []string{"Preparing worktree", "fatal: invalid reference: nope"}, "fatal: invalid reference: nope"},
+		{"error", []string{"error: pathspec 'x' did not match"}, "error: pathspec 'x' did not match"},
+		{"first line otherwise", []string{"something went wrong", ""}, "something went wrong"},
+		{"empty output", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorLine(tt.lines); got != tt.want {
+				t.Errorf("ErrorLine(%q) = %q, want %q", tt.lines, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorWithoutOutput(t *testing.T) {
+	err := &Error{Err: errors.New("exit status 128")}
+	if got := err.Error(); got != "exit status 128" {
+		t.Errorf("Error() = %q, want the wrapped error", got)
+	}
+
+	runner := &fakeRunner{outputs: map[string][]string{"-C /repo/a log -1 --format=%ct": nil}}
+	repo := Repo{Git: "git", Path: "/repo", Runner: runner}
+	if got := repo.LastCommitAt("/repo/a"); !got.IsZero() {
+		t.Errorf("LastCommitAt = %v, want the zero time", got)
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	lines := []string{
+		"worktree /repo",
+		"bare",
+		"",
+		"worktree /repo/feature",
+		"HEAD 97cb16522daa830809f5621c3fe097e453da5125",
+		"branch refs/heads/feature",
+		"",
+		"",
+	}
+
+	records := SplitRecords(lines)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+
+	if len(records[1]) != 3 {
+		t.Errorf("second record has %d lines, want 3", len(records[1]))
+	}
+
+	if got := SplitRecords([]string{""}); len(got) != 0 {
+		t.Errorf("empty output gave %d records, want 0", len(got))
+	}
+}
+
+func TestList(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string][]string{
+		"-C /src/app worktree list --porcelain": {
+			"worktree /src/app",
+			"HEAD 97cb16522daa830809f5621c3fe097e453da5125",
+			"branch refs/heads/main",
+			"",
+			"worktree /src/feature",
+			"HEAD 97cb16522daa830809f5621c3fe097e453da5125",
+			"branch refs/heads/feature",
+			"",
+		},
+		"-C /src/feature status --porcelain":  {" M README.md", ""},
+		"-C /src/feature log -1 --format=%ct": {"1700000000", ""},
+	}}
+	repo := Repo{Git: "git", Path: "/src/app", Runner: runner}
+
+	worktrees, err := repo.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(worktrees) != 2 {
+		t.Fatalf("got %d worktrees, want 2", len(worktrees))
+	}
+
+	if !worktrees[0].Main || worktrees[1].Main {
+		t.Errorf("only the first worktree should be the main one, got %+v", worktrees)
+	}
+
+	if worktrees[0].Dirty || !worktrees[1].Dirty {
+		t.Errorf("only feature should be dirty, got %+v", worktrees)
+	}
+
+	if !worktrees[0].LastCommitAt.IsZero() || worktrees[1].LastCommitAt.Unix() != 1700000000 {
+		t.Errorf("only feature should have a commit time, got %+v", worktrees)
+	}
+}
+
+func TestListError(t *testing.T) {
+	runner := &fakeRunner{fails: map[string]bool{
+		"-C /repo worktree list --porcelain": true,
+	}}
+	repo := Repo{Git: "git", Path: "/repo", Runner: runner}
+
+	_, err := repo.List()
+
+	var gitErr *Error
+	if !errors.As(err, &gitErr) {
+		t.Fatalf("got %v, want an *Error", err)
+	}
+
+	if want := "fatal: -C /repo worktree list --porcelain"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tree := Worktree{Path: "/repo/usb", Name: "usb", Branch: "usb", Locked: true}
+
+	tests := []struct {
+		name  string
+		force bool
+		want  []string
+	}{
+		{
+			name: "plain",
+			want: []string{
+				"-C /repo worktree remove /repo/usb",
+				"-C /repo branch -d usb",
+			},
+		},
+		{
+			name:  "forced and locked",
+			force: true,
+			want: []string{
+				"-C /repo worktree remove /repo/usb --force --force",
+				"-C /repo branch -D usb",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			repo := Repo{Git: "git", Path: "/repo", Runner: runner}
+
+			if err := repo.Remove(tree, test.force); err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.DeleteBranch(tree.Branch, test.force); err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(runner.calls, test.want) {
+				t.Errorf("calls = %q, want %q", runner.calls, test.want)
+			}
+		})
+	}
+}
+
+func TestExecRunnerTimeout(t *testing.T) {
+	runner := ExecRunner{Timeout: 50 * time.Millisecond}
+
+	out, err := runner.Run("sleep", []string{"5"})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+
+	if want := "sleep timed out after 50ms"; ErrorLine(out) != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestExecRunnerTimeoutWithChildren(t *testing.T) {
+	// Like git leaving an ssh behind that keeps the output open.
+	script := filepath.Join(t.TempDir(), "git")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nsleep 10 &\nsleep 10\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	runner := ExecRunner{Timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	_, err := runner.Run(script, nil)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+
+	if took := time.Since(start); took > runner.Timeout+waitDelay+time.Second {
+		t.Errorf("Run took %s, want it to stop waiting after the timeout", took)
+	}
+}